@@ -2,29 +2,19 @@ package main
 
 import (
 	"awesomeProject/internal/common"
-	"awesomeProject/internal/proxy"
 	"awesomeProject/internal/tunnel"
-	"bufio"
+	"awesomeProject/pkg/client"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
-
-	"github.com/gorilla/websocket"
-)
-
-var (
-	serverURL  string
-	tunnelID   string
-	targetURL  string
-	tcpTarget  string
-	conn       *websocket.Conn
-	tunnelConn *tunnel.Tunnel
-	tcpConns   sync.Map // connID -> net.Conn
 )
 
 func main() {
@@ -33,344 +23,177 @@ func main() {
 	if configPath == "" {
 		configPath = "./configs/client.yaml"
 	}
-	config, err := common.LoadConfig(configPath)
-	if err != nil {
-		log.Fatalf("加载配置文件失败: %v", err)
-	}
-
-	// 检查客户端配置
-	if config.TunnelClient.ServerURL == "" {
-		log.Fatalf("配置文件中 tunnel_client.server_url 未设置")
-	}
-	if config.TunnelClient.TargetURL == "" {
-		log.Fatalf("配置文件中 tunnel_client.target_url 未设置")
-	}
-
-	serverURL = config.TunnelClient.ServerURL
-	tunnelID = config.TunnelClient.TunnelID
-	targetURL = config.TunnelClient.TargetURL
-	tcpTarget = config.TunnelClient.TCPTarget
 
-	log.Printf("配置加载成功: %s v%s", config.App.Name, config.App.Version)
-	log.Printf("连接到服务端: %s", serverURL)
-	log.Printf("目标服务地址: %s", targetURL)
-	if tunnelID != "" {
-		log.Printf("使用隧道ID: %s", tunnelID)
+	// check-config 子命令：仅校验配置并打印所有问题
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		if len(os.Args) > 2 {
+			configPath = os.Args[2]
+		}
+		os.Exit(common.RunCheckConfig(configPath, common.RoleClient))
 	}
 
-	// 连接到服务端
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+	// serve 子命令：把本地目录作为静态文件站点经隧道发布，无需另起本地Web服务
+	var serve *common.StaticConfig
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve = parseServeArgs(os.Args[2:])
 	}
 
-	conn, _, err = dialer.Dial(serverURL, nil)
+	config, err := common.LoadConfig(configPath)
 	if err != nil {
-		log.Fatalf("连接服务端失败: %v", err)
+		log.Fatalf("加载配置文件失败: %v", err)
 	}
-	defer conn.Close()
 
-	log.Println("已连接到服务端")
-
-	// 注册隧道
-	registerMsg := tunnel.Message{
-		Type:     tunnel.MessageTypeRegister,
-		TunnelID: tunnelID,
+	if serve != nil {
+		// 发布目录代替 target_url，未指定目录时使用配置中的 static.dir
+		static := &config.TunnelClient.Static
+		if serve.Dir != "" {
+			static.Dir = serve.Dir
+		}
+		static.Listing = static.Listing || serve.Listing
+		static.SPA = static.SPA || serve.SPA
+		config.TunnelClient.TargetURL = ""
 	}
 
-	err = conn.WriteJSON(registerMsg)
-	if err != nil {
-		log.Fatalf("发送注册消息失败: %v", err)
+	// 校验客户端配置
+	if err := config.Validate(common.RoleClient); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	// 等待注册响应
-	var registerResp tunnel.Message
-	err = conn.ReadJSON(&registerResp)
+	cfg := config.TunnelClient
+	log.Printf("配置加载成功: %s v%s", config.App.Name, config.App.Version)
+	if len(cfg.ServerURLs) == 0 {
+		log.Printf("连接到服务端: %s", cfg.ServerURL)
+	} else {
+		urls := cfg.ServerURLs
+		if cfg.ServerURL != "" {
+			urls = append([]string{cfg.ServerURL}, urls...)
+		}
+		log.Printf("服务端地址（按优先级）: %s", strings.Join(urls, ", "))
+	}
+	if cfg.TargetURL != "" {
+		log.Printf("目标服务地址: %s", cfg.TargetURL)
+	}
+	var handler http.Handler
+	if cfg.Static.Dir != "" {
+		log.Printf("发布静态文件目录: %s", cfg.Static.Dir)
+		handler = client.StaticHandler(client.Static{Dir: cfg.Static.Dir, Listing: cfg.Static.Listing, SPA: cfg.Static.SPA})
+	}
+	if cfg.Mirror.TargetURL != "" {
+		log.Printf("流量镜像到: %s", cfg.Mirror.TargetURL)
+	}
+	if cfg.TunnelID != "" {
+		log.Printf("使用隧道ID: %s", cfg.TunnelID)
+	}
+
+	var services []client.Service
+	for _, svc := range cfg.Services {
+		services = append(services, client.Service{Name: svc.Name, Secret: svc.Secret, LocalAddr: svc.LocalAddr, Allow: svc.Allow, E2EKey: svc.E2EKey})
+	}
+	var visitors []client.Visitor
+	for _, v := range cfg.Visitors {
+		visitors = append(visitors, client.Visitor{Name: v.Name, Secret: v.Secret, BindAddr: v.BindAddr, Proxy: v.Proxy, E2EKey: v.E2EKey})
+	}
+
+	var stubs []client.Stub
+	for _, stub := range cfg.Stubs {
+		stubs = append(stubs, client.Stub{Method: stub.Method, Path: stub.Path, Status: stub.Status, Headers: stub.Headers, Body: stub.Body, File: stub.File})
+	}
+
+	c, err := client.New(client.Options{
+		ServerURL:        cfg.ServerURL,
+		ServerURLs:       cfg.ServerURLs,
+		TunnelID:         cfg.TunnelID,
+		Version:          config.App.Version,
+		TargetURL:        cfg.TargetURL,
+		Handler:          handler,
+		TCPTarget:        cfg.TCPTarget,
+		ServerProxy:      cfg.ServerProxy,
+		Services:         services,
+		Visitors:         visitors,
+		ProxyAllow:       cfg.ProxyAllow,
+		Stubs:            stubs,
+		RequestTimeout:   time.Duration(cfg.RequestTimeout) * time.Second,
+		WSMaxMessageSize: cfg.WSMaxMessageSize,
+		UpstreamProtocol: cfg.UpstreamProtocol,
+		Compression:      tunnel.CompressionFromConfig(cfg.Compression),
+		HealthCheck: &client.HealthCheck{
+			Interval: time.Duration(cfg.HealthCheck.Interval) * time.Second,
+			Timeout:  time.Duration(cfg.HealthCheck.Timeout) * time.Second,
+			Path:     cfg.HealthCheck.Path,
+			Failures: cfg.HealthCheck.Failures,
+		},
+		Mirror: &client.Mirror{
+			TargetURL: cfg.Mirror.TargetURL,
+			Percent:   cfg.Mirror.Percent,
+			Diff:      cfg.Mirror.Diff,
+			Timeout:   time.Duration(cfg.Mirror.Timeout) * time.Second,
+		},
+		OnConnected: func(tunnelID string) {
+			log.Printf("隧道注册成功，隧道ID: %s", tunnelID)
+			log.Printf("外部访问地址: http://服务端地址/你的路径（单隧道默认）")
+			log.Printf("多隧道场景访问: http://服务端地址/tunnel/%s/你的路径", tunnelID)
+		},
+		OnDisconnected: func(err error) {
+			log.Printf("与服务端的连接已断开: %v", err)
+		},
+	})
 	if err != nil {
-		log.Fatalf("读取注册响应失败: %v", err)
-	}
-
-	if registerResp.TunnelID != "" {
-		tunnelID = registerResp.TunnelID
-		log.Printf("隧道注册成功，隧道ID: %s", tunnelID)
-		log.Printf("外部访问地址: http://服务端地址/你的路径（单隧道默认）")
-		log.Printf("多隧道场景访问: http://服务端地址/tunnel/%s/你的路径", tunnelID)
+		log.Fatalf("创建客户端失败: %v", err)
 	}
 
-	// 创建隧道连接对象
-	tunnelConn = tunnel.NewTunnel(tunnelID, conn)
-
-	// 启动心跳
-	go startHeartbeat()
-
-	// 启动请求处理
-	go handleRequests()
-
 	// 等待中断信号
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("正在关闭连接...")
-}
-
-// startHeartbeat 启动心跳
-func startHeartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		pingMsg := tunnel.Message{
-			Type:     tunnel.MessageTypePong,
-			TunnelID: tunnelID,
-		}
-
-		if err := tunnelConn.SendMessage(&pingMsg); err != nil {
-			log.Printf("发送心跳失败: %v", err)
-			return
-		}
+	if err := c.Start(ctx); err != nil {
+		log.Fatalf("%v", err)
 	}
-}
-
-// handleRequests 处理来自服务端的请求
-func handleRequests() {
-	for {
-		var msg tunnel.Message
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket连接关闭: %v", err)
-			}
-			return
-		}
-
-		// 处理心跳
-		if msg.Type == tunnel.MessageTypePing {
-			pongMsg := tunnel.Message{
-				Type:     tunnel.MessageTypePong,
-				TunnelID: tunnelID,
-			}
-			tunnelConn.SendMessage(&pongMsg)
-			tunnelConn.UpdatePing()
-			continue
-		}
 
-		// 处理请求
-		if msg.Type == tunnel.MessageTypeRequest {
-			go handleRequest(&msg)
-		}
-
-		// 处理TCP隧道初始化
-		if msg.Type == tunnel.MessageTypeTCPInit {
-			go handleTCPInit(&msg)
-		}
-
-		// 处理TCP数据（必须保持顺序，不能开goroutine）
-		if msg.Type == tunnel.MessageTypeTCPData {
-			handleTCPData(&msg)
-		}
-
-		// 处理TCP关闭
-		if msg.Type == tunnel.MessageTypeTCPClose {
-			handleTCPClose(&msg)
-		}
-
-		// 处理WebSocket请求
-		if msg.Type == tunnel.MessageTypeWebSocket {
-			go handleWebSocketRequest(&msg)
-		}
-
-		// 处理WebSocket数据消息
-		if msg.Type == tunnel.MessageTypeWebSocketData {
-			// WebSocket数据消息通过消息分发器处理
-			tunnelConn.DispatchMessage(&msg)
-		}
+	if cfg.StatusAddr != "" {
+		go serveStatus(cfg.StatusAddr, c)
 	}
-}
 
-// handleRequest 处理单个请求
-func handleRequest(msg *tunnel.Message) {
-	// 检查是否是SSE请求
-	if proxy.IsSSERequest(msg.Headers) {
-		handleSSERequest(msg)
-		return
+	select {
+	case <-ctx.Done():
+	case <-c.Done():
 	}
 
-	// 处理普通HTTP请求
-	respMsg, err := proxy.HandleClientRequest(targetURL, msg)
-	if err != nil {
-		errorMsg := tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: err.Error(),
-		}
-		tunnelConn.SendMessage(&errorMsg)
-		return
-	}
-
-	// 发送响应
-	err = tunnelConn.SendMessage(respMsg)
-	if err != nil {
-		log.Printf("发送响应失败: %v", err)
-	}
-}
-
-// handleTCPInit 处理TCP隧道初始化
-func handleTCPInit(msg *tunnel.Message) {
-	if tcpTarget == "" {
-		errMsg := &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "客户端未配置 tcp_target，无法建立TCP隧道",
-		}
-		tunnelConn.SendMessage(errMsg)
-		return
-	}
-
-	localConn, err := net.Dial("tcp", tcpTarget)
-	if err != nil {
-		errMsg := &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "连接本地TCP失败: " + err.Error(),
-		}
-		tunnelConn.SendMessage(errMsg)
-		return
-	}
-
-	tcpConns.Store(msg.ID, localConn)
-
-	// 将本地TCP的数据转发到服务端
-	go func(connID string, c net.Conn) {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := c.Read(buf)
-			if n > 0 {
-				data := make([]byte, n)
-				copy(data, buf[:n])
-				dataMsg := &tunnel.Message{
-					Type: tunnel.MessageTypeTCPData,
-					ID:   connID,
-					Body: data,
-				}
-				if err := tunnelConn.SendMessage(dataMsg); err != nil {
-					log.Printf("发送TCP数据失败: %v", err)
-					break
-				}
-			}
-			if err != nil {
-				closeMsg := &tunnel.Message{
-					Type: tunnel.MessageTypeTCPClose,
-					ID:   connID,
-				}
-				tunnelConn.SendMessage(closeMsg)
-				break
-			}
-		}
-		tcpConns.Delete(connID)
-		c.Close()
-	}(msg.ID, localConn)
+	log.Println("正在关闭连接...")
+	c.Close()
 }
 
-// handleTCPData 将服务端的数据写入本地TCP连接
-func handleTCPData(msg *tunnel.Message) {
-	if v, ok := tcpConns.Load(msg.ID); ok {
-		if c, ok2 := v.(net.Conn); ok2 {
-			if _, err := c.Write(msg.Body); err != nil {
-				log.Printf("写入本地TCP失败: %v", err)
-				handleTCPClose(msg)
-			}
-		}
-	}
+// parseServeArgs 解析 serve 子命令的参数：client serve [-listing] [-spa] [目录]
+func parseServeArgs(args []string) *common.StaticConfig {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: client serve [-listing] [-spa] [目录]")
+		fmt.Fprintln(fs.Output(), "未指定目录时使用配置中的 tunnel_client.static.dir")
+		fs.PrintDefaults()
+	}
+	static := &common.StaticConfig{}
+	fs.BoolVar(&static.Listing, "listing", false, "没有 index.html 的目录列出文件")
+	fs.BoolVar(&static.SPA, "spa", false, "单页应用：浏览器访问不存在的路径时返回 index.html")
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		static.Dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return static
 }
 
-// handleTCPClose 关闭本地TCP连接
-func handleTCPClose(msg *tunnel.Message) {
-	if v, ok := tcpConns.Load(msg.ID); ok {
-		if c, ok2 := v.(net.Conn); ok2 {
-			c.Close()
-		}
-		tcpConns.Delete(msg.ID)
+// serveStatus 在 addr 上提供本地状态接口 GET /status，返回当前服务端及各服务端的健康状态
+func serveStatus(addr string, c *client.Client) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	log.Printf("本地状态接口: http://%s/status", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("本地状态接口启动失败: %v", err)
 	}
 }
-
-// handleSSERequest 处理SSE请求
-func handleSSERequest(msg *tunnel.Message) {
-	// 构建目标URL
-	fullURL := targetURL + msg.Path
-
-	// 创建HTTP请求
-	req, err := http.NewRequest(msg.Method, fullURL, nil)
-	if err != nil {
-		errorMsg := tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "创建请求失败: " + err.Error(),
-		}
-		tunnelConn.SendMessage(&errorMsg)
-		return
-	}
-
-	// 设置请求头
-	for key, values := range msg.Headers {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
-	}
-
-	// 设置SSE相关请求头
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Cache-Control", "no-cache")
-
-	// 发送请求
-	client := &http.Client{
-		Timeout: 0, // SSE是长连接，不设置超时
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		errorMsg := tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "请求失败: " + err.Error(),
-		}
-		tunnelConn.SendMessage(&errorMsg)
-		return
-	}
-	defer resp.Body.Close()
-
-	// 使用bufio.Scanner按行读取SSE流
-	scanner := bufio.NewScanner(resp.Body)
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024) // 设置缓冲区大小
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			sseMsg := tunnel.Message{
-				Type:    tunnel.MessageTypeSSE,
-				ID:      msg.ID,
-				SSEData: line,
-			}
-
-			if err := tunnelConn.SendMessage(&sseMsg); err != nil {
-				log.Printf("发送SSE数据失败: %v", err)
-				return
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("读取SSE流失败: %v", err)
-		errorMsg := tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "读取SSE流失败: " + err.Error(),
-		}
-		tunnelConn.SendMessage(&errorMsg)
-	}
-}
-
-// handleWebSocketRequest 处理WebSocket请求
-func handleWebSocketRequest(msg *tunnel.Message) {
-	proxy.HandleClientWebSocket(targetURL, msg, tunnelConn)
-}
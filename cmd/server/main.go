@@ -4,41 +4,45 @@ import (
 	"awesomeProject/internal/common"
 	"awesomeProject/internal/proxy"
 	"awesomeProject/internal/tunnel"
-	"crypto/rand"
-	"encoding/hex"
+	"awesomeProject/pkg/server"
+	"context"
+	"crypto/subtle"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"net"
+	"net/http"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	// 集群登记使用的数据库驱动
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
-var tunnelManager *tunnel.Manager
-var httpProxy *proxy.HTTPProxy
-var isPrivateUse bool
-var tcpPort int
-var tcpConns sync.Map // connID -> net.Conn
-
 func main() {
 	// 加载配置文件（可通过环境变量覆盖）
 	configPath := os.Getenv("TUNNEL_SERVER_CONFIG")
 	if configPath == "" {
 		configPath = "./configs/server.yaml"
 	}
+
+	// check-config 子命令：仅校验配置并打印所有问题
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		if len(os.Args) > 2 {
+			configPath = os.Args[2]
+		}
+		os.Exit(common.RunCheckConfig(configPath, common.RoleServer))
+	}
+
 	config, err := common.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("加载配置文件失败: %v", err)
 	}
 
-	// 检查服务端配置
-	if config.TunnelServer.Port == 0 {
-		log.Fatalf("配置文件中 tunnel_server.port 未设置")
+	// 校验服务端配置并填充默认值
+	if err := config.Validate(common.RoleServer); err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	log.Printf("配置加载成功: %s v%s", config.App.Name, config.App.Version)
@@ -49,391 +53,149 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	// 初始化隧道管理器
-	tunnelManager = tunnel.NewManager()
-	httpProxy = proxy.NewHTTPProxy(tunnelManager)
-	isPrivateUse = config.TunnelServer.PrivateUse
-	tcpPort = config.TunnelServer.TCPPort
-
-	// 启动心跳检测
-	tunnelManager.StartHeartbeat()
-
-	// 创建Gin路由器
-	router := gin.Default()
-
-	// WebSocket连接端点（客户端连接）- 必须在通配符路由之前
-	router.GET("/ws", handleWebSocket)
-
-	// 健康检查 - 必须在通配符路由之前
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
-
-	// 根据配置决定是否启用多隧道路由
-	if !config.TunnelServer.PrivateUse {
-		// HTTP代理端点（外部请求）- 多隧道场景
-		router.Any("/tunnel/:tunnelID/*path", handleProxyRequest)
-		log.Println("多隧道模式已启用，支持 /tunnel/{隧道ID}/ 前缀访问")
-	} else {
-		log.Println("私人使用模式已启用，仅支持直接路径访问（无需 /tunnel/ 前缀）")
-	}
-
-	// 单隧道场景下的简化访问（使用 NoRoute 处理未匹配的路由）
-	router.NoRoute(handleDefaultProxyRequest)
-
-	// 启动TCP穿透监听
-	if tcpPort > 0 {
-		go startTCPListener(tcpPort)
-		log.Printf("TCP穿透监听端口: %d", tcpPort)
-	} else {
-		log.Println("TCP穿透未开启，如需开启请配置 tunnel_server.tcp_port")
-	}
-
-	// 启动服务器
-	port := fmt.Sprintf(":%d", config.TunnelServer.Port)
-	log.Printf("内网穿透服务端启动在端口 %s", port)
-	if err := router.Run(port); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
-	}
-}
-
-// handleWebSocket 处理WebSocket连接（客户端连接）
-func handleWebSocket(c *gin.Context) {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("WebSocket升级失败: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	log.Println("新的WebSocket连接")
-
-	// 等待客户端注册消息
-	var tunnelID string
-	for {
-		var msg tunnel.Message
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("读取消息失败: %v", err)
-			return
-		}
-
-		if msg.Type == tunnel.MessageTypeRegister {
-			tunnelID = msg.TunnelID
-			if tunnelID == "" {
-				// 如果没有提供tunnelID，生成一个
-				tunnelID = generateTunnelID()
-			}
-
-			// 注册隧道
-			tunnelConn := tunnelManager.RegisterTunnel(tunnelID, conn)
-
-			// 发送注册成功消息
-			response := tunnel.Message{
-				Type:     tunnel.MessageTypeResponse,
-				TunnelID: tunnelID,
+	// 集群模式：隧道登记在共享目录或数据库中，落到其他节点的请求转发到隧道所在节点
+	var cluster *server.ClusterOptions
+	if clusterCfg := config.TunnelServer.Cluster; clusterCfg.AdvertiseURL != "" {
+		var store server.ClusterStore
+		if clusterCfg.StoreDir != "" {
+			store, err = server.NewDirStore(clusterCfg.StoreDir)
+			if err != nil {
+				log.Fatalf("打开集群登记目录失败: %v", err)
 			}
-			conn.WriteJSON(response)
-
-			log.Printf("隧道注册成功: %s", tunnelID)
-
-			// 启动消息分发器
-			tunnelConn.StartMessageDispatcher()
-			break
-		} else if msg.Type == tunnel.MessageTypePong {
-			// 心跳响应
-			if tunnelConn, exists := tunnelManager.GetTunnel(msg.TunnelID); exists {
-				tunnelConn.UpdatePing()
+		} else {
+			store, err = openSQLStore(config.Database)
+			if err != nil {
+				log.Fatalf("打开集群登记数据库失败: %v", err)
 			}
+			log.Printf("集群登记使用数据库: %s", config.Database.Driver)
 		}
-	}
-
-	// 保持连接
-	select {}
-}
-
-// handleProxyRequest 处理代理请求（外部HTTP请求）
-func handleProxyRequest(c *gin.Context) {
-	tunnelID := c.Param("tunnelID")
-	path := c.Param("path")
-	processProxyRequest(c, tunnelID, path)
-}
-
-// handleDefaultProxyRequest 处理无隧道前缀的代理请求（单隧道场景）
-// 作为 NoRoute 处理器，处理所有未匹配的路由
-func handleDefaultProxyRequest(c *gin.Context) {
-	// 从请求URL获取路径
-	path := c.Request.URL.Path
-	
-	// 确保路径以 / 开头
-	if path == "" {
-		path = "/"
-	}
-
-	var tunnelID string
-	var ok bool
-
-	if isPrivateUse {
-		// 私人使用模式：使用第一个可用隧道
-		tunnelID, ok = tunnelManager.GetFirstTunnelID()
-		if !ok {
-			c.JSON(503, gin.H{"error": "没有可用的隧道连接"})
-			return
-		}
-	} else {
-		// 多隧道模式：仅当存在唯一隧道时才允许省略前缀
-		tunnelID, ok = tunnelManager.GetSingleTunnelID()
-		if !ok {
-			c.JSON(400, gin.H{"error": "请使用 /tunnel/{隧道ID}/ 前缀访问或仅保持一个隧道连接"})
-			return
+		cluster = &server.ClusterOptions{
+			NodeID:       clusterCfg.NodeID,
+			AdvertiseURL: clusterCfg.AdvertiseURL,
+			Token:        clusterCfg.Token,
+			Store:        store,
+			TTL:          time.Duration(clusterCfg.TTL) * time.Second,
 		}
+		log.Printf("集群模式已启用，本节点地址: %s", clusterCfg.AdvertiseURL)
 	}
 
-	processProxyRequest(c, tunnelID, path)
-}
-
-// processProxyRequest 统一的代理处理逻辑
-func processProxyRequest(c *gin.Context, tunnelID, path string) {
-	// 获取隧道连接
-	tunnelConn, exists := tunnelManager.GetTunnel(tunnelID)
-	if !exists {
-		c.JSON(503, gin.H{"error": "隧道不存在或未连接"})
-		return
-	}
-
-	// 读取请求体
-	body, err := io.ReadAll(c.Request.Body)
+	// 错误页模板：未配置时使用内置模板
+	errorPages, err := server.LoadErrorPages(config.TunnelServer.ErrorPage)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "读取请求体失败"})
-		return
-	}
-
-	// 构建请求消息
-	requestID := generateRequestID()
-	// 将查询参数附加到路径上
-	fullPath := path
-	if c.Request.URL.RawQuery != "" {
-		fullPath = path + "?" + c.Request.URL.RawQuery
-	}
-	msg := &tunnel.Message{
-		Type:    tunnel.MessageTypeRequest,
-		ID:      requestID,
-		Method:  c.Request.Method,
-		Path:    fullPath,
-		Headers: c.Request.Header,
-		Body:    body,
-	}
-
-	// 检查是否是SSE请求
-	if proxy.IsSSERequest(c.Request.Header) {
-		handleSSEProxy(c, tunnelConn, msg)
-		return
-	}
-
-	// 检查是否是WebSocket请求
-	if proxy.IsWebSocketRequest(c.Request.Header) {
-		proxy.HandleWebSocketProxy(c, tunnelConn, requestID, fullPath)
-		return
+		log.Fatalf("加载错误页模板失败: %v", err)
 	}
 
-	// 转发HTTP请求
-	respMsg, err := httpProxy.ForwardRequest(tunnelID, msg)
+	// 隧道离线时的维护页与请求等待
+	offline, err := server.OfflineFromConfig(config.TunnelServer.Offline)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "转发请求失败: " + err.Error()})
-		return
+		log.Fatalf("加载维护页失败: %v", err)
 	}
-
-	if respMsg.Type == tunnel.MessageTypeError {
-		c.JSON(500, gin.H{"error": respMsg.Error})
-		return
-	}
-
-	// 设置响应头
-	for key, values := range respMsg.Headers {
-		for _, value := range values {
-			c.Header(key, value)
-		}
-	}
-
-	// 返回响应
-	c.Data(respMsg.Status, c.GetHeader("Content-Type"), respMsg.Body)
-}
-
-// handleSSEProxy 处理SSE代理请求
-func handleSSEProxy(c *gin.Context, tunnelConn *tunnel.Tunnel, msg *tunnel.Message) {
-	// 发送请求到客户端
-	err := tunnelConn.SendMessage(msg)
+	tunnelOffline, err := server.TunnelOfflineFromConfig(config.TunnelServer)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "发送请求失败: " + err.Error()})
-		return
+		log.Fatalf("加载维护页失败: %v", err)
 	}
 
-	// 设置SSE响应头
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
-
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		c.JSON(500, gin.H{"error": "响应不支持流式传输"})
-		return
-	}
-
-	flusher.Flush()
+	// 响应缓存
+	cache, err := server.CacheFromConfig(config.TunnelServer)
+	if err != nil {
+		log.Fatalf("创建响应缓存失败: %v", err)
+	}
+
+	// 管理接口
+	var admin *server.AdminOptions
+	if token := config.TunnelServer.Admin.Token; token != "" {
+		admin = &server.AdminOptions{Token: token}
+		log.Printf("管理接口已启用: /_admin")
+	}
+
+	// 初始化隧道服务
+	proxyCfg := config.TunnelServer.Proxy
+	tunnelServer := server.New(server.Options{
+		PrivateUse:       config.TunnelServer.PrivateUse,
+		Timeouts:         proxy.TimeoutsFromConfig(config.TunnelServer.Timeouts),
+		TunnelTimeouts:   proxy.TunnelTimeoutsFromConfig(config.TunnelServer),
+		WSMaxMessageSize: config.TunnelServer.WSMaxMessageSize,
+		Compression:      tunnel.CompressionFromConfig(config.TunnelServer.Compression),
+		ProxyTunnel:      proxyCfg.TunnelID,
+		ProxyAuth: func(username, password string) bool {
+			return subtle.ConstantTimeCompare([]byte(username), []byte(proxyCfg.Username)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(password), []byte(proxyCfg.Password)) == 1
+		},
+		Cluster:            cluster,
+		MinProtocolVersion: config.TunnelServer.MinProtocolVersion,
+		ErrorPages:         errorPages,
+		Offline:            offline,
+		TunnelOffline:      tunnelOffline,
+		Rewrite:            proxy.RewriteFromConfig(config.TunnelServer.Rewrite),
+		TunnelRewrite:      proxy.TunnelRewritesFromConfig(config.TunnelServer),
+		Cache:              cache,
+		Admin:              admin,
+	})
+	defer tunnelServer.Close()
 
-	// 注册SSE响应通道
-	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
-	defer tunnelConn.UnregisterResponseChan(msg.ID)
+	// 创建Gin路由器并注册隧道路由
+	router := gin.Default()
+	tunnelServer.Mount(router)
 
-	// 监听SSE消息
-	timeout := time.After(5 * time.Minute) // SSE超时5分钟
-	for {
-		select {
-		case <-timeout:
-			return
-		case respMsg := <-responseChan:
-			// 检查是否是当前请求的SSE消息
-			if respMsg.Type == tunnel.MessageTypeSSE && respMsg.ID == msg.ID {
-				// 写入SSE数据
-				c.Writer.Write([]byte(respMsg.SSEData + "\n"))
-				flusher.Flush()
-			} else if respMsg.Type == tunnel.MessageTypeError && respMsg.ID == msg.ID {
-				// 错误消息
-				c.Writer.Write([]byte("event: error\ndata: " + respMsg.Error + "\n\n"))
-				flusher.Flush()
-				return
-			}
+	// 启动TCP穿透监听
+	if tcpPort := config.TunnelServer.TCPPort; tcpPort > 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", tcpPort))
+		if err != nil {
+			log.Printf("启动TCP监听失败: %v", err)
+		} else {
+			go tunnelServer.ServeTCP(ln)
+			log.Printf("TCP穿透监听端口: %d", tcpPort)
 		}
-	}
-}
-
-// startTCPListener 启动TCP穿透监听
-func startTCPListener(port int) {
-	addr := fmt.Sprintf(":%d", port)
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Printf("启动TCP监听失败: %v", err)
-		return
+	} else {
+		log.Println("TCP穿透未开启，如需开启请配置 tunnel_server.tcp_port")
 	}
 
-	for {
-		publicConn, err := ln.Accept()
+	// 启动 SOCKS5/HTTP CONNECT 代理入口
+	if proxyCfg.Port > 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", proxyCfg.Port))
 		if err != nil {
-			log.Printf("接受TCP连接失败: %v", err)
-			continue
+			log.Printf("启动代理监听失败: %v", err)
+		} else {
+			go tunnelServer.ServeProxy(ln)
+			log.Printf("SOCKS5/HTTP CONNECT 代理端口: %d", proxyCfg.Port)
 		}
-		go handleTCPConnection(publicConn)
-	}
-}
-
-// handleTCPConnection 处理单个TCP连接
-func handleTCPConnection(publicConn net.Conn) {
-	tunnelID, ok := selectTunnelIDForTCP()
-	if !ok {
-		log.Printf("无可用隧道，拒绝TCP连接来自 %s", publicConn.RemoteAddr().String())
-		publicConn.Close()
-		return
 	}
 
-	tunnelConn, exists := tunnelManager.GetTunnel(tunnelID)
-	if !exists {
-		log.Printf("隧道 %s 不存在，拒绝TCP连接", tunnelID)
-		publicConn.Close()
-		return
+	// 启动服务器
+	port := fmt.Sprintf(":%d", config.TunnelServer.Port)
+	srv := &http.Server{
+		Addr:         port,
+		Handler:      router,
+		ReadTimeout:  time.Duration(config.TunnelServer.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(config.TunnelServer.WriteTimeout) * time.Second,
+	}
+	// 同时接受 HTTP/1.1 和 h2c（gRPC 客户端不经TLS直接以HTTP/2连接），使用TLS时协商 h2
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	log.Printf("内网穿透服务端启动在端口 %s", port)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("服务器启动失败: %v", err)
 	}
+}
 
-	connID := generateRequestID()
-
-	// 注册响应通道
-	responseChan := tunnelConn.RegisterResponseChan(connID)
-	defer tunnelConn.UnregisterResponseChan(connID)
-
-	// 发送TCP初始化消息
-	initMsg := &tunnel.Message{
-		Type: tunnel.MessageTypeTCPInit,
-		ID:   connID,
-	}
-	if err := tunnelConn.SendMessage(initMsg); err != nil {
-		log.Printf("发送TCP初始化失败: %v", err)
-		publicConn.Close()
-		return
+// openSQLStore 连接 database 配置的数据库作为集群登记存储
+func openSQLStore(cfg common.DatabaseConfig) (server.ClusterStore, error) {
+	db, err := cfg.Open()
+	if err != nil {
+		return nil, err
 	}
-
-	// 从公网读取数据并转发给内网
-	go func() {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := publicConn.Read(buf)
-			if n > 0 {
-				data := make([]byte, n)
-				copy(data, buf[:n])
-				dataMsg := &tunnel.Message{
-					Type: tunnel.MessageTypeTCPData,
-					ID:   connID,
-					Body: data,
-				}
-				if err := tunnelConn.SendMessage(dataMsg); err != nil {
-					log.Printf("发送TCP数据失败: %v", err)
-					break
-				}
-			}
-			if err != nil {
-				closeMsg := &tunnel.Message{
-					Type: tunnel.MessageTypeTCPClose,
-					ID:   connID,
-				}
-				tunnelConn.SendMessage(closeMsg)
-				break
-			}
-		}
-	}()
-
-	// 从内网读取数据并转发给公网
-	for {
-		msg, ok := <-responseChan
-		if !ok {
-			break
-		}
-
-		switch msg.Type {
-		case tunnel.MessageTypeTCPData:
-			if _, err := publicConn.Write(msg.Body); err != nil {
-				log.Printf("写入公网TCP失败: %v", err)
-				publicConn.Close()
-				return
-			}
-		case tunnel.MessageTypeTCPClose, tunnel.MessageTypeError:
-			publicConn.Close()
-			return
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
 	}
-}
-
-// selectTunnelIDForTCP 选择用于TCP穿透的隧道ID
-func selectTunnelIDForTCP() (string, bool) {
-	if isPrivateUse {
-		return tunnelManager.GetFirstTunnelID()
+	store, err := server.NewSQLStore(ctx, db, cfg.SQLDriver())
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
-	return tunnelManager.GetSingleTunnelID()
-}
-
-// generateTunnelID 生成隧道ID
-func generateTunnelID() string {
-	bytes := make([]byte, 8)
-	rand.Read(bytes)
-	return "tunnel-" + hex.EncodeToString(bytes)
-}
-
-// generateRequestID 生成请求ID
-func generateRequestID() string {
-	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	return "req-" + hex.EncodeToString(bytes)
+	return store, nil
 }
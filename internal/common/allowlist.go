@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrTargetNotAllowed 目标地址不在允许列表中
+var ErrTargetNotAllowed = errors.New("目标地址不在允许列表中")
+
+// Allowlist 代理出口的目标地址允许列表
+// 规则支持：* （全部）、CIDR（10.0.0.0/8）、IP、主机名、*.后缀通配（*.corp.internal），均可附加 :端口
+type Allowlist struct {
+	rules []allowRule
+}
+
+type allowRule struct {
+	any    bool
+	cidr   *net.IPNet
+	host   string // 小写主机名或IP，以 "*." 开头表示后缀匹配
+	port   int    // 0表示任意端口
+	hasDNS bool   // 规则是主机名，需按名称匹配
+}
+
+// ParseAllowlist 解析允许列表，空列表返回 nil
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	a := &Allowlist{}
+	for _, entry := range entries {
+		rule, err := parseAllowRule(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func parseAllowRule(entry string) (allowRule, error) {
+	if entry == "" {
+		return allowRule{}, errors.New("允许列表中存在空规则")
+	}
+	if entry == "*" {
+		return allowRule{any: true}, nil
+	}
+
+	// CIDR 不带端口
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return allowRule{}, fmt.Errorf("%q 不是有效的CIDR", entry)
+		}
+		return allowRule{cidr: ipNet}, nil
+	}
+
+	host, port := entry, 0
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || !validPort(n) {
+			return allowRule{}, fmt.Errorf("%q 端口无效", entry)
+		}
+		host, port = h, n
+	}
+	if host == "" {
+		return allowRule{}, fmt.Errorf("%q 缺少主机", entry)
+	}
+	host = strings.ToLower(host)
+	return allowRule{host: host, port: port, hasDNS: net.ParseIP(host) == nil}, nil
+}
+
+// matchName 按主机名匹配（不解析DNS）
+func (r allowRule) matchName(host string, port int) bool {
+	if r.any {
+		return true
+	}
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if !r.hasDNS || r.cidr != nil {
+		return false
+	}
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// matchIP 按IP匹配
+func (r allowRule) matchIP(ip net.IP, port int) bool {
+	if r.any {
+		return true
+	}
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.cidr != nil {
+		return r.cidr.Contains(ip)
+	}
+	if !r.hasDNS {
+		return net.ParseIP(r.host).Equal(ip)
+	}
+	return false
+}
+
+// Dial 校验目标地址后拨号
+// 主机名规则按名称匹配；IP/CIDR规则按解析结果匹配，并直接连接匹配的IP，避免解析结果在校验后被替换
+func (a *Allowlist) Dial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("目标地址 %q 无效", target)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !validPort(port) {
+		return nil, fmt.Errorf("目标地址 %q 端口无效", target)
+	}
+	host = strings.ToLower(host)
+
+	for _, rule := range a.rules {
+		if rule.matchName(host, port) {
+			return dial(ctx, "tcp", target)
+		}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		for _, rule := range a.rules {
+			if rule.matchIP(ip, port) {
+				return dial(ctx, "tcp", net.JoinHostPort(ip.String(), portStr))
+			}
+		}
+	}
+	return nil, ErrTargetNotAllowed
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 支持的数据库类型（database.driver）
+const (
+	DatabaseMySQL    = "mysql"
+	DatabasePostgres = "postgres"
+	DatabaseSQLite   = "sqlite"
+)
+
+// SQLDriver 返回 database/sql 注册的驱动名：mysql、pgx
+func (d DatabaseConfig) SQLDriver() string {
+	switch d.Driver {
+	case DatabasePostgres:
+		return "pgx"
+	default:
+		return d.Driver
+	}
+}
+
+// DSN 按配置生成连接字符串
+func (d DatabaseConfig) DSN() string {
+	switch d.Driver {
+	case DatabaseMySQL:
+		charset := d.Charset
+		if charset == "" {
+			charset = "utf8mb4"
+		}
+		port := d.Port
+		if port == 0 {
+			port = 3306
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=%s",
+			d.Username, d.Password, net.JoinHostPort(d.Host, strconv.Itoa(port)), d.DBName, url.QueryEscape(charset))
+	case DatabasePostgres:
+		port := d.Port
+		if port == 0 {
+			port = 5432
+		}
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(d.Username, d.Password),
+			Host:   net.JoinHostPort(d.Host, strconv.Itoa(port)),
+			Path:   "/" + d.DBName,
+		}
+		return u.String()
+	default:
+		return ""
+	}
+}
+
+// Open 打开数据库并设置连接池，调用方需导入对应的 database/sql 驱动
+func (d DatabaseConfig) Open() (*sql.DB, error) {
+	db, err := sql.Open(d.SQLDriver(), d.DSN())
+	if err != nil {
+		return nil, err
+	}
+	if d.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(d.MaxIdleConns)
+	}
+	if d.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(d.MaxOpenConns)
+	}
+	if d.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(d.ConnMaxLifetime) * time.Second)
+	}
+	return db, nil
+}
+
+// validate 校验集群登记使用的数据库配置
+// sqlite 需要 cgo（发布版本以 CGO_ENABLED=0 构建），单机文件也无法被多个节点共享，不能用于登记
+func (d DatabaseConfig) validate(path string) []string {
+	var problems []string
+	switch d.Driver {
+	case DatabaseMySQL, DatabasePostgres:
+		if d.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s.host 未设置", path))
+		}
+		if d.DBName == "" {
+			problems = append(problems, fmt.Sprintf("%s.dbname 未设置", path))
+		}
+		if d.Port != 0 && !validPort(d.Port) {
+			problems = append(problems, fmt.Sprintf("%s.port 超出范围: %d", path, d.Port))
+		}
+	case DatabaseSQLite:
+		problems = append(problems, fmt.Sprintf("%s.driver 为 sqlite 时不能用于集群登记（各节点无法共享单机数据库文件），请使用 mysql/postgres 或设置 tunnel_server.cluster.store_dir", path))
+	default:
+		problems = append(problems, fmt.Sprintf("%s.driver 取值无效: %q（集群登记可选 mysql/postgres）", path, d.Driver))
+	}
+	if d.MaxIdleConns < 0 || d.MaxOpenConns < 0 || d.ConnMaxLifetime < 0 {
+		problems = append(problems, fmt.Sprintf("%s 的连接池设置不能为负数", path))
+	}
+	return problems
+}
@@ -0,0 +1,670 @@
+package common
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError 配置校验错误，汇总全部问题而不是遇到第一个就返回
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "配置校验失败:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate 校验配置并填充默认值
+// role 决定校验 tunnel_server 还是 tunnel_client，所有问题通过 *ValidationError 一次性返回
+func (c *Config) Validate(role ConfigRole) error {
+	var problems []string
+	problems = append(problems, c.unknownKeys...)
+
+	switch role {
+	case RoleServer:
+		c.TunnelServer.applyDefaults()
+		problems = append(problems, c.TunnelServer.validate()...)
+		// 集群未设置共享目录时使用 database 登记隧道
+		if cl := c.TunnelServer.Cluster; cl.AdvertiseURL != "" && cl.StoreDir == "" {
+			if c.Database.Driver == "" {
+				problems = append(problems, "tunnel_server.cluster.store_dir 未设置（或配置 database 使用数据库登记）")
+			} else {
+				problems = append(problems, c.Database.validate("database")...)
+			}
+		}
+	case RoleClient:
+		c.TunnelClient.applyDefaults()
+		problems = append(problems, c.TunnelClient.validate()...)
+	default:
+		problems = append(problems, fmt.Sprintf("未知的配置角色: %s", role))
+	}
+
+	switch c.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log.level 取值无效: %q（可选 debug/info/warn/error）", c.Log.Level))
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// applyDefaults 填充服务端默认值
+func (s *TunnelServerConfig) applyDefaults() {
+	if s.Port == 0 {
+		s.Port = DefaultServerPort
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = DefaultReadTimeout
+	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = DefaultWriteTimeout
+	}
+	s.Timeouts = ProxyTimeoutConfig{
+		Forward: DefaultForwardTimeout,
+		SSE:     DefaultSSETimeout,
+		Upgrade: DefaultUpgradeTimeout,
+	}.Merge(s.Timeouts)
+}
+
+// applyDefaults 填充客户端默认值
+func (t *TunnelClientConfig) applyDefaults() {
+	if t.RequestTimeout == 0 {
+		t.RequestTimeout = DefaultRequestTimeout
+	}
+}
+
+// validate 校验服务端配置
+func (s *TunnelServerConfig) validate() []string {
+	var problems []string
+
+	if !validPort(s.Port) {
+		problems = append(problems, fmt.Sprintf("tunnel_server.port 超出范围: %d（1-65535）", s.Port))
+	}
+	if s.TCPPort != 0 {
+		if !validPort(s.TCPPort) {
+			problems = append(problems, fmt.Sprintf("tunnel_server.tcp_port 超出范围: %d（0表示关闭，或1-65535）", s.TCPPort))
+		} else if s.TCPPort == s.Port {
+			problems = append(problems, fmt.Sprintf("tunnel_server.tcp_port 与 tunnel_server.port 冲突: 都为 %d", s.Port))
+		}
+	}
+	if s.Proxy.Port != 0 {
+		switch {
+		case !validPort(s.Proxy.Port):
+			problems = append(problems, fmt.Sprintf("tunnel_server.proxy.port 超出范围: %d（0表示关闭，或1-65535）", s.Proxy.Port))
+		case s.Proxy.Port == s.Port:
+			problems = append(problems, fmt.Sprintf("tunnel_server.proxy.port 与 tunnel_server.port 冲突: 都为 %d", s.Port))
+		case s.Proxy.Port == s.TCPPort:
+			problems = append(problems, fmt.Sprintf("tunnel_server.proxy.port 与 tunnel_server.tcp_port 冲突: 都为 %d", s.TCPPort))
+		}
+		// 代理入口可访问客户端所在的整个内网，必须认证
+		if s.Proxy.Username == "" || s.Proxy.Password == "" {
+			problems = append(problems, "tunnel_server.proxy 开启时必须设置 username 和 password")
+		}
+	}
+	problems = append(problems, s.Compression.validate("tunnel_server.compression")...)
+	if c := s.Cluster; c.AdvertiseURL != "" {
+		if err := checkURL(c.AdvertiseURL, "http", "https"); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_server.cluster.advertise_url 无效: %v", err))
+		}
+		if c.Token == "" {
+			problems = append(problems, "tunnel_server.cluster.token 未设置")
+		}
+		if c.TTL < 0 {
+			problems = append(problems, fmt.Sprintf("tunnel_server.cluster.ttl 不能为负数: %d", c.TTL))
+		}
+	}
+	// 管理接口与代理路由共用端口，密钥过短容易被猜中
+	if token := s.Admin.Token; token != "" && len(token) < 16 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.admin.token 过短: %d 个字符（至少16个）", len(token)))
+	}
+	if s.ReadTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.read_timeout 不能为负数: %d", s.ReadTimeout))
+	}
+	if s.WriteTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.write_timeout 不能为负数: %d", s.WriteTimeout))
+	}
+
+	if s.MinProtocolVersion < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.min_protocol_version 不能为负数: %d", s.MinProtocolVersion))
+	}
+	if s.ErrorPage != "" {
+		if _, err := template.ParseFiles(s.ErrorPage); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_server.error_page 无效: %v", err))
+		}
+	}
+	if s.WSMaxMessageSize < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.ws_max_message_size 不能为负数: %d", s.WSMaxMessageSize))
+	}
+
+	problems = append(problems, s.validateTimeouts("tunnel_server.timeouts", s.Timeouts)...)
+	problems = append(problems, s.Offline.validate("tunnel_server.offline", s.WriteTimeout)...)
+	problems = append(problems, s.Rewrite.validate("tunnel_server.rewrite")...)
+	problems = append(problems, s.Cache.validate("tunnel_server.cache")...)
+	ids := make([]string, 0, len(s.Tunnels))
+	for id := range s.Tunnels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		opts := s.Tunnels[id]
+		if id == "" {
+			problems = append(problems, "tunnel_server.tunnels 中存在空的隧道ID")
+		}
+		path := fmt.Sprintf("tunnel_server.tunnels.%s.timeouts", id)
+		problems = append(problems, s.validateTimeouts(path, s.Timeouts.Merge(opts.Timeouts))...)
+		if !opts.Rewrite.Empty() {
+			problems = append(problems, opts.Rewrite.validate(fmt.Sprintf("tunnel_server.tunnels.%s.rewrite", id))...)
+		}
+		if opts.Offline != (OfflineConfig{}) {
+			problems = append(problems, s.Offline.Merge(opts.Offline).validate(fmt.Sprintf("tunnel_server.tunnels.%s.offline", id), s.WriteTimeout)...)
+		}
+	}
+
+	if s.PrivateUse {
+		problems = append(problems, s.validatePrivateUse(ids)...)
+	}
+
+	return problems
+}
+
+// validatePrivateUse 私人使用模式下始终只路由到第一个可用隧道，按隧道区分的配置没有意义，应写在全局默认值中
+func (s *TunnelServerConfig) validatePrivateUse(ids []string) []string {
+	var problems []string
+	if len(s.Tunnels) > 1 {
+		problems = append(problems, fmt.Sprintf("tunnel_server.private_use 为 true 时只会使用一个隧道，但 tunnel_server.tunnels 配置了 %d 个隧道", len(s.Tunnels)))
+	}
+	conflict := func(id, section string) {
+		problems = append(problems, fmt.Sprintf("tunnel_server.private_use 为 true 时不支持 tunnel_server.tunnels.%s.%s，请改用 tunnel_server.%s", id, section, section))
+	}
+	for _, id := range ids {
+		opts := s.Tunnels[id]
+		if opts.Timeouts != (ProxyTimeoutConfig{}) {
+			conflict(id, "timeouts")
+		}
+		if opts.Offline != (OfflineConfig{}) {
+			conflict(id, "offline")
+		}
+		if !opts.Rewrite.Empty() {
+			conflict(id, "rewrite")
+		}
+		if opts.Cache != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_server.private_use 为 true 时不支持 tunnel_server.tunnels.%s.cache，请改用 tunnel_server.cache.enabled", id))
+		}
+	}
+	return problems
+}
+
+// validate 校验改写规则
+func (r RewriteConfig) validate(path string) []string {
+	var problems []string
+	problems = append(problems, r.RequestHeaders.validate(path+".request_headers")...)
+	problems = append(problems, r.ResponseHeaders.validate(path+".response_headers")...)
+	for i, host := range r.LocalHosts {
+		if host == "" || strings.Contains(host, "/") {
+			problems = append(problems, fmt.Sprintf("%s.local_hosts[%d] 应为 主机 或 主机:端口（不含协议）: %q", path, i, host))
+		}
+	}
+	for i, b := range r.Body {
+		if b.From == "" {
+			problems = append(problems, fmt.Sprintf("%s.body[%d].from 未设置", path, i))
+		}
+	}
+	return problems
+}
+
+// validate 校验头部改写规则
+func (h HeaderRulesConfig) validate(path string) []string {
+	var problems []string
+	check := func(field, name string) {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			problems = append(problems, fmt.Sprintf("%s.%s 中的头部名称无效: %q", path, field, name))
+		}
+	}
+	for _, name := range sortedKeys(h.Add) {
+		check("add", name)
+	}
+	for _, name := range sortedKeys(h.Set) {
+		check("set", name)
+	}
+	for _, name := range h.Remove {
+		check("remove", name)
+	}
+	return problems
+}
+
+// sortedKeys 返回排序后的键，保证校验错误的顺序稳定
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validate 校验响应缓存配置
+func (c CacheConfig) validate(path string) []string {
+	var problems []string
+	if c.MaxSize < 0 {
+		problems = append(problems, fmt.Sprintf("%s.max_size 不能为负数: %d", path, c.MaxSize))
+	}
+	if c.MaxEntrySize < 0 {
+		problems = append(problems, fmt.Sprintf("%s.max_entry_size 不能为负数: %d", path, c.MaxEntrySize))
+	}
+	if c.MaxSize > 0 && c.MaxEntrySize > c.MaxSize {
+		problems = append(problems, fmt.Sprintf("%s.max_entry_size (%d) 超过 max_size (%d)", path, c.MaxEntrySize, c.MaxSize))
+	}
+	if c.Dir != "" {
+		if info, err := os.Stat(c.Dir); err == nil && !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s.dir 不是目录: %s", path, c.Dir))
+		}
+	}
+	return problems
+}
+
+// validate 校验离线处理配置（已合并默认值）
+func (o OfflineConfig) validate(path string, writeTimeout int) []string {
+	var problems []string
+	if o.Wait < 0 {
+		problems = append(problems, fmt.Sprintf("%s.wait 不能为负数: %d", path, o.Wait))
+	}
+	// 等待期间同样计入 write_timeout，等待过久时响应会被服务器截断
+	if writeTimeout > 0 && o.Wait >= writeTimeout {
+		problems = append(problems, fmt.Sprintf("%s.wait (%d) 不小于 tunnel_server.write_timeout (%d)，等待后的响应会被截断", path, o.Wait, writeTimeout))
+	}
+	if o.Page != "" {
+		if info, err := os.Stat(o.Page); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.page 无法读取: %v", path, err))
+		} else if info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s.page 不是文件: %s", path, o.Page))
+		}
+	}
+	return problems
+}
+
+// validateTimeouts 校验一组代理超时（已合并默认值）
+func (s *TunnelServerConfig) validateTimeouts(path string, t ProxyTimeoutConfig) []string {
+	var problems []string
+
+	fields := []struct {
+		name  string
+		value int
+	}{{"forward", t.Forward}, {"idle", t.Idle}, {"sse", t.SSE}, {"upgrade", t.Upgrade}}
+	for _, f := range fields {
+		if f.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s.%s 不能为负数: %d", path, f.name, f.value))
+		}
+	}
+
+	// 普通HTTP响应受 write_timeout 约束，等待时间更长会被服务器提前截断
+	if s.WriteTimeout > 0 && t.Forward > s.WriteTimeout {
+		problems = append(problems, fmt.Sprintf("%s.forward (%d) 超过 tunnel_server.write_timeout (%d)，响应会被提前截断", path, t.Forward, s.WriteTimeout))
+	}
+
+	return problems
+}
+
+// validate 校验客户端配置
+func (t *TunnelClientConfig) validate() []string {
+	var problems []string
+
+	if t.ServerURL == "" && len(t.ServerURLs) == 0 {
+		problems = append(problems, "tunnel_client.server_url 与 server_urls 至少设置一个")
+	} else if t.ServerURL != "" {
+		if err := checkURL(t.ServerURL, "ws", "wss"); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.server_url 无效: %v", err))
+		}
+	}
+	for i, u := range t.ServerURLs {
+		if err := checkURL(u, "ws", "wss"); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.server_urls[%d] 无效: %v", i, err))
+		}
+	}
+
+	if t.StatusAddr != "" {
+		if err := checkHostPort(t.StatusAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.status_addr 无效: %v", err))
+		}
+	}
+
+	if t.ServerProxy != "" && t.ServerProxy != "direct" {
+		if err := checkURL(t.ServerProxy, "http", "socks5"); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.server_proxy 无效: %v", err))
+		}
+	}
+
+	// 仅作为访问者、仅发布私有服务或发布静态文件站点时可以不设置 target_url
+	if t.Static.Dir != "" {
+		if t.TargetURL != "" {
+			problems = append(problems, "tunnel_client.target_url 与 static.dir 不能同时设置")
+		}
+		if info, err := os.Stat(t.Static.Dir); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.static.dir 无法读取: %v", err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("tunnel_client.static.dir 不是目录: %s", t.Static.Dir))
+		}
+	} else if t.TargetURL == "" {
+		if len(t.Visitors) == 0 && len(t.Services) == 0 {
+			problems = append(problems, "tunnel_client.target_url 未设置")
+		}
+	} else if err := checkURL(t.TargetURL, "http", "https"); err != nil {
+		problems = append(problems, fmt.Sprintf("tunnel_client.target_url 无效: %v", err))
+	}
+
+	if t.RequestTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_client.request_timeout 不能为负数: %d", t.RequestTimeout))
+	}
+
+	if t.WSMaxMessageSize < 0 {
+		problems = append(problems, fmt.Sprintf("tunnel_client.ws_max_message_size 不能为负数: %d", t.WSMaxMessageSize))
+	}
+
+	switch t.UpstreamProtocol {
+	case "", "auto", "http1", "http2":
+	default:
+		problems = append(problems, fmt.Sprintf("tunnel_client.upstream_protocol 无效: %q（可选 auto、http1、http2）", t.UpstreamProtocol))
+	}
+
+	if t.TCPTarget != "" {
+		if err := checkHostPort(t.TCPTarget); err != nil {
+			problems = append(problems, fmt.Sprintf("tunnel_client.tcp_target 无效: %v", err))
+		}
+	}
+
+	serviceNames := make(map[string]bool)
+	for i, svc := range t.Services {
+		path := fmt.Sprintf("tunnel_client.services[%d]", i)
+		if svc.Name == "" {
+			problems = append(problems, path+".name 未设置")
+		} else if serviceNames[svc.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name 重复: %s", path, svc.Name))
+		}
+		serviceNames[svc.Name] = true
+		if svc.Secret == "" {
+			problems = append(problems, path+".secret 未设置")
+		}
+		if svc.LocalAddr == "" {
+			if len(svc.Allow) == 0 {
+				problems = append(problems, path+".local_addr 与 allow 至少设置一个")
+			}
+		} else if err := checkHostPort(svc.LocalAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.local_addr 无效: %v", path, err))
+		}
+		if _, err := ParseAllowlist(svc.Allow); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.allow 无效: %v", path, err))
+		}
+		// secret 会发送给服务端校验，与其相同的 e2e_key 起不到加密作用
+		if svc.E2EKey != "" && svc.E2EKey == svc.Secret {
+			problems = append(problems, path+".e2e_key 不能与 secret 相同")
+		}
+	}
+
+	problems = append(problems, t.Compression.validate("tunnel_client.compression")...)
+	problems = append(problems, t.HealthCheck.validate("tunnel_client.health_check")...)
+	problems = append(problems, t.Mirror.validate("tunnel_client.mirror")...)
+	for i, stub := range t.Stubs {
+		problems = append(problems, stub.validate(fmt.Sprintf("tunnel_client.stubs[%d]", i))...)
+	}
+
+	if _, err := ParseAllowlist(t.ProxyAllow); err != nil {
+		problems = append(problems, fmt.Sprintf("tunnel_client.proxy_allow 无效: %v", err))
+	}
+
+	bindAddrs := make(map[string]bool)
+	for i, v := range t.Visitors {
+		path := fmt.Sprintf("tunnel_client.visitors[%d]", i)
+		if v.Name == "" {
+			problems = append(problems, path+".name 未设置")
+		}
+		if v.Secret == "" {
+			problems = append(problems, path+".secret 未设置")
+		}
+		if v.BindAddr == "" {
+			problems = append(problems, path+".bind_addr 未设置")
+		} else if err := checkHostPort(v.BindAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.bind_addr 无效: %v", path, err))
+		} else if bindAddrs[v.BindAddr] {
+			problems = append(problems, fmt.Sprintf("%s.bind_addr 重复: %s", path, v.BindAddr))
+		}
+		bindAddrs[v.BindAddr] = true
+		if v.E2EKey != "" && v.E2EKey == v.Secret {
+			problems = append(problems, path+".e2e_key 不能与 secret 相同")
+		}
+	}
+
+	return problems
+}
+
+// validate 校验健康检查配置
+func (h HealthCheckConfig) validate(path string) []string {
+	var problems []string
+	fields := []struct {
+		name  string
+		value int
+	}{{"interval", h.Interval}, {"timeout", h.Timeout}, {"failures", h.Failures}}
+	for _, f := range fields {
+		if f.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s.%s 不能为负数: %d", path, f.name, f.value))
+		}
+	}
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		problems = append(problems, fmt.Sprintf("%s.path 必须以 / 开头: %s", path, h.Path))
+	}
+	if h.Interval > 0 && h.Timeout > h.Interval {
+		problems = append(problems, fmt.Sprintf("%s.timeout (%d) 超过 interval (%d)", path, h.Timeout, h.Interval))
+	}
+	return problems
+}
+
+// validate 校验流量镜像配置
+func (m MirrorConfig) validate(path string) []string {
+	var problems []string
+	if m.TargetURL != "" {
+		if err := checkURL(m.TargetURL, "http", "https"); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.target_url 无效: %v", path, err))
+		}
+	}
+	// 未设置时不默认镜像全部流量，需明确给出采样比例
+	if m.TargetURL != "" && m.Percent == 0 {
+		problems = append(problems, path+".percent 未设置（1-100，如全部镜像填100）")
+	} else if m.Percent < 0 || m.Percent > 100 {
+		problems = append(problems, fmt.Sprintf("%s.percent 超出范围: %g（应大于0且不超过100）", path, m.Percent))
+	}
+	if m.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("%s.timeout 不能为负数: %d", path, m.Timeout))
+	}
+	return problems
+}
+
+// validate 校验模拟响应配置
+func (s StubConfig) validate(path string) []string {
+	var problems []string
+	if s.Path == "" {
+		problems = append(problems, path+".path 未设置")
+	} else if _, err := regexp.Compile(s.Path); err != nil {
+		problems = append(problems, fmt.Sprintf("%s.path 不是有效的正则表达式: %v", path, err))
+	}
+	if s.Status != 0 && (s.Status < 100 || s.Status > 599) {
+		problems = append(problems, fmt.Sprintf("%s.status 无效: %d", path, s.Status))
+	}
+	if s.File != "" {
+		if s.Body != "" {
+			problems = append(problems, path+".body 与 file 不能同时设置")
+		}
+		if info, err := os.Stat(s.File); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.file 无法读取: %v", path, err))
+		} else if info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s.file 不是文件: %s", path, s.File))
+		}
+	}
+	return problems
+}
+
+// validate 校验压缩配置
+func (c CompressionConfig) validate(path string) []string {
+	var problems []string
+	if c.Level < 0 || c.Level > 9 {
+		problems = append(problems, fmt.Sprintf("%s.level 超出范围: %d（0表示默认，或1-9）", path, c.Level))
+	}
+	if c.MinSize < 0 {
+		problems = append(problems, fmt.Sprintf("%s.min_size 不能为负数: %d", path, c.MinSize))
+	}
+	return problems
+}
+
+// checkURL 检查URL格式、协议与主机
+func checkURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	schemeOK := false
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			schemeOK = true
+			break
+		}
+	}
+	if !schemeOK {
+		return fmt.Errorf("%q 协议必须为 %s", raw, strings.Join(schemes, "/"))
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q 缺少主机地址", raw)
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || !validPort(n) {
+			return fmt.Errorf("%q 端口无效", raw)
+		}
+	}
+	return nil
+}
+
+// checkHostPort 检查 host:port 形式的地址
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q 需要 host:port 格式", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || !validPort(n) {
+		return fmt.Errorf("%q 端口无效", addr)
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// collectUnknownKeys 对照结构体的 yaml 标签遍历配置节点，收集未知的配置项
+func collectUnknownKeys(node *yaml.Node, t reflect.Type, path string, out *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	if node.Kind == yaml.DocumentNode {
+		for _, child := range node.Content {
+			collectUnknownKeys(child, t, path, out)
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			fieldType, ok := fields[key]
+			if !ok {
+				*out = append(*out, fmt.Sprintf("未知配置项: %s", joinKeyPath(path, key)))
+				continue
+			}
+			collectUnknownKeys(node.Content[i+1], fieldType, joinKeyPath(path, key), out)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			collectUnknownKeys(node.Content[i+1], t.Elem(), joinKeyPath(path, node.Content[i].Value), out)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, child := range node.Content {
+			collectUnknownKeys(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i), out)
+		}
+	}
+}
+
+// yamlFields 返回结构体中 yaml 键名到字段类型的映射（含 inline 字段）
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(field.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// RunCheckConfig 执行 check-config 子命令：加载并校验配置，打印全部问题
+// 返回进程退出码（0表示通过）
+func RunCheckConfig(configPath string, role ConfigRole) int {
+	fmt.Printf("检查配置文件: %s\n", configPath)
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := config.Validate(role); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("配置校验通过")
+	return 0
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultErrorPage 未配置模板时使用的错误页
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>{{.Code}}</small></p>
+</body>
+</html>
+`
+
+// ErrorPageData 错误页模板的数据
+type ErrorPageData struct {
+	Status     int              // HTTP状态码
+	StatusText string           // 状态码说明，如 Bad Gateway
+	Code       tunnel.ErrorCode // 错误码，如 upstream_unreachable
+	Message    string           // 错误信息
+	Path       string           // 请求路径
+}
+
+// ErrorPages 对外部调用方返回的错误响应
+// 按 Accept 协商：浏览器（优先 text/html）得到HTML错误页，其余得到 {"error": ..., "code": ...} JSON；
+// gRPC 请求得到携带 grpc-status/grpc-message 的响应
+type ErrorPages struct {
+	tmpl *template.Template
+}
+
+var defaultErrorPages = &ErrorPages{tmpl: template.Must(template.New("error").Parse(defaultErrorPage))}
+
+// LoadErrorPages 加载HTML错误页模板（html/template 语法，数据见 ErrorPageData），path 为空时使用内置模板
+func LoadErrorPages(path string) (*ErrorPages, error) {
+	if path == "" {
+		return defaultErrorPages, nil
+	}
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorPages{tmpl: tmpl}, nil
+}
+
+// Write 写入错误响应，状态码由错误码决定；nil 时使用内置模板
+// 请求方已断开（canceled）时不写入
+func (p *ErrorPages) Write(c *gin.Context, code tunnel.ErrorCode, message string) {
+	if p == nil {
+		p = defaultErrorPages
+	}
+	status := code.HTTPStatus()
+	if code == tunnel.ErrCanceled {
+		c.Status(status)
+		return
+	}
+
+	// gRPC 调用方只认 grpc-status，以 Trailers-Only 响应返回
+	if IsGRPCRequest(c.Request.Header) {
+		for key, values := range grpcStatus(code, message) {
+			c.Writer.Header()[key] = values
+		}
+		c.Header("Content-Type", "application/grpc")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+		c.JSON(status, gin.H{"error": message, "code": code})
+		return
+	}
+
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		Message:    message,
+		Path:       c.Request.URL.Path,
+	}
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, data); err != nil {
+		log.Printf("渲染错误页失败: %v", err)
+		c.JSON(status, gin.H{"error": message, "code": code})
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// grpcStatus 返回错误对应的 grpc-status 和 grpc-message 头
+func grpcStatus(code tunnel.ErrorCode, message string) http.Header {
+	return http.Header{
+		"Grpc-Status":  {strconv.Itoa(code.GRPCStatus())},
+		"Grpc-Message": {grpcEncodeMessage(message)},
+	}
+}
+
+// grpcEncodeMessage 按 gRPC 协议对 grpc-message 做百分号编码（可打印ASCII之外的字节及 % 本身）
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		ch := message[i]
+		if ch < 0x20 || ch > 0x7e || ch == '%' {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
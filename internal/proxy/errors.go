@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/tunnel"
+)
+
+// UpstreamErrorCode 按访问本地服务（或代理目标）时的错误归类错误码
+func UpstreamErrorCode(err error) tunnel.ErrorCode {
+	if errors.Is(err, common.ErrTargetNotAllowed) {
+		return tunnel.ErrForbidden
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return tunnel.ErrUpstreamTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return tunnel.ErrUpstreamTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return tunnel.ErrUpstreamUnreachable
+	}
+	// 拨号阶段失败（拒绝连接、网络不可达等）
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return tunnel.ErrUpstreamUnreachable
+	}
+	return tunnel.ErrUpstreamError
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"time"
@@ -11,109 +12,106 @@ import (
 
 // HTTPProxy HTTP代理
 type HTTPProxy struct {
-	manager *tunnel.Manager
-	client  *http.Client
+	manager  *tunnel.Manager
+	timeouts Timeouts
+	tunnels  map[string]Timeouts // tunnelID -> 覆盖后的超时
 }
 
 // NewHTTPProxy 创建HTTP代理
-func NewHTTPProxy(manager *tunnel.Manager) *HTTPProxy {
-	return &HTTPProxy{
-		manager: manager,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// tunnels 为按隧道覆盖的超时设置，未列出的隧道使用 timeouts
+func NewHTTPProxy(manager *tunnel.Manager, timeouts Timeouts, tunnels map[string]Timeouts) *HTTPProxy {
+	p := &HTTPProxy{
+		manager:  manager,
+		timeouts: timeouts,
+		tunnels:  make(map[string]Timeouts, len(tunnels)),
 	}
+	for id, t := range tunnels {
+		p.tunnels[id] = t
+	}
+	return p
+}
+
+// Timeouts 返回指定隧道生效的超时设置
+func (p *HTTPProxy) Timeouts(tunnelID string) Timeouts {
+	if t, ok := p.tunnels[tunnelID]; ok {
+		return t
+	}
+	return p.timeouts
 }
 
 // ForwardRequest 转发HTTP请求
-func (p *HTTPProxy) ForwardRequest(tunnelID string, msg *tunnel.Message) (*tunnel.Message, error) {
+// ctx 结束（外部调用方断开）或等待超时时，通知客户端取消该请求
+func (p *HTTPProxy) ForwardRequest(ctx context.Context, tunnelID string, msg *tunnel.Message) (*tunnel.Message, error) {
 	// 获取隧道连接
 	tunnelConn, exists := p.manager.GetTunnel(tunnelID)
 	if !exists {
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "隧道不存在",
-		}, nil
+		return tunnel.NewError(msg.ID, tunnel.ErrTunnelNotFound, "隧道不存在"), nil
 	}
 
 	// 注册响应通道
 	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
 	defer tunnelConn.UnregisterResponseChan(msg.ID)
-	
+
 	// 发送请求到客户端
 	err := tunnelConn.SendMessage(msg)
 	if err != nil {
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "发送请求失败: " + err.Error(),
-		}, nil
+		return tunnel.NewError(msg.ID, tunnel.ErrTunnelDisconnected, "发送请求失败: "+err.Error()), nil
 	}
 
 	// 等待响应（设置超时）
-	timeout := time.After(30 * time.Second)
-	
+	timeout := time.After(p.Timeouts(tunnelID).Forward)
+
 	// 等待响应或超时
 	select {
 	case respMsg := <-responseChan:
 		return respMsg, nil
 	case <-timeout:
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "请求超时",
-		}, nil
+		tunnelConn.CancelStream(msg.ID)
+		return tunnel.NewError(msg.ID, tunnel.ErrUpstreamTimeout, "请求超时"), nil
+	case <-ctx.Done():
+		tunnelConn.CancelStream(msg.ID)
+		return tunnel.NewError(msg.ID, tunnel.ErrCanceled, "请求已取消"), nil
+	case <-tunnelConn.Done():
+		return tunnel.NewError(msg.ID, tunnel.ErrTunnelDisconnected, "隧道已断开"), nil
 	}
 }
 
-// HandleClientRequest 客户端处理请求（转发到本地服务）
-func HandleClientRequest(targetURL string, msg *tunnel.Message) (*tunnel.Message, error) {
+// HandleRequest 客户端处理请求（转发到本地服务）
+// ctx 被取消（服务端发来 cancel）时中止对本地服务的请求
+func (u *Upstream) HandleRequest(ctx context.Context, msg *tunnel.Message) (*tunnel.Message, error) {
 	// 构建目标URL
-	fullURL := targetURL + msg.Path
-	
+	fullURL := u.TargetURL + msg.Path
+
 	// 创建HTTP请求
-	req, err := http.NewRequest(msg.Method, fullURL, bytes.NewReader(msg.Body))
+	req, err := http.NewRequestWithContext(ctx, msg.Method, fullURL, bytes.NewReader(msg.Body))
 	if err != nil {
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "创建请求失败: " + err.Error(),
-		}, nil
+		return tunnel.NewError(msg.ID, tunnel.ErrBadRequest, "创建请求失败: "+err.Error()), nil
 	}
-	
-	// 设置请求头
+
+	// 设置请求头，HTTP/2 不允许携带逐跳头
+	http2 := u.useHTTP2(msg.Headers)
 	for key, values := range msg.Headers {
+		if http2 && isHopHeader(key) {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(key, value)
 		}
 	}
-	
+
 	// 发送请求
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	
-	resp, err := client.Do(req)
+	resp, err := u.httpClient(msg.Headers, false).Do(req)
 	if err != nil {
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "请求失败: " + err.Error(),
-		}, nil
+		return tunnel.NewError(msg.ID, UpstreamErrorCode(err), "请求失败: "+err.Error()), nil
 	}
 	defer resp.Body.Close()
-	
+
 	// 读取响应体
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "读取响应失败: " + err.Error(),
-		}, nil
+		return tunnel.NewError(msg.ID, UpstreamErrorCode(err), "读取响应失败: "+err.Error()), nil
 	}
-	
+
 	// 构建响应消息
 	responseMsg := &tunnel.Message{
 		Type:    tunnel.MessageTypeResponse,
@@ -122,12 +120,15 @@ func HandleClientRequest(targetURL string, msg *tunnel.Message) (*tunnel.Message
 		Headers: make(map[string][]string),
 		Body:    body,
 	}
-	
+
 	// 复制响应头
 	for key, values := range resp.Header {
 		responseMsg.Headers[key] = values
 	}
-	
+	// trailers 在读完响应体后才可用
+	if len(resp.Trailer) > 0 {
+		responseMsg.Trailers = resp.Trailer
+	}
+
 	return responseMsg, nil
 }
-
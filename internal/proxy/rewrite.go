@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/tunnel"
+)
+
+// HeaderRules 头部改写规则，按 Remove、Set、Add 的顺序执行
+type HeaderRules struct {
+	Add    map[string]string
+	Set    map[string]string
+	Remove []string
+}
+
+// BodyReplace 响应体文本替换
+type BodyReplace struct {
+	From string
+	To   string
+}
+
+// Rewrite 请求/响应改写规则
+// 请求头规则对所有请求生效；响应头规则和 Location、Set-Cookie 改写对所有响应生效，响应体只改写普通HTTP请求
+type Rewrite struct {
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+	// LocalHosts 本地服务的 主机:端口，响应中指向这些地址的 Location、Set-Cookie 的 Domain 和HTML中的绝对链接改写为公网地址
+	LocalHosts []string
+	// Body HTML响应体的文本替换，在 LocalHosts 改写之后执行
+	Body []BodyReplace
+}
+
+// PublicOrigin 外部调用方看到的地址
+type PublicOrigin struct {
+	Scheme string // http 或 https
+	Host   string // 主机:端口（Host 头）
+	Prefix string // 隧道路径前缀，如 /tunnel/solosw，无前缀访问时为空
+}
+
+// String 返回 scheme://host/prefix
+func (o PublicOrigin) String() string {
+	return o.Scheme + "://" + o.Host + o.Prefix
+}
+
+// RewriteFromConfig 将配置转换为改写规则，没有任何规则时返回 nil
+func RewriteFromConfig(cfg common.RewriteConfig) *Rewrite {
+	if cfg.Empty() {
+		return nil
+	}
+	r := &Rewrite{
+		RequestHeaders:  HeaderRules(cfg.RequestHeaders),
+		ResponseHeaders: HeaderRules(cfg.ResponseHeaders),
+		LocalHosts:      cfg.LocalHosts,
+	}
+	for _, b := range cfg.Body {
+		r.Body = append(r.Body, BodyReplace(b))
+	}
+	return r
+}
+
+// TunnelRewritesFromConfig 按隧道合并全局与隧道级的改写规则
+func TunnelRewritesFromConfig(cfg common.TunnelServerConfig) map[string]*Rewrite {
+	tunnels := make(map[string]*Rewrite, len(cfg.Tunnels))
+	for id, opts := range cfg.Tunnels {
+		tunnels[id] = RewriteFromConfig(cfg.Rewrite.Merge(opts.Rewrite))
+	}
+	return tunnels
+}
+
+// apply 在 h 上执行规则
+func (r HeaderRules) apply(h http.Header) {
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Set {
+		h.Set(name, value)
+	}
+	for name, value := range r.Add {
+		h.Add(name, value)
+	}
+}
+
+// rewritesBody 是否需要改写响应体
+func (r *Rewrite) rewritesBody() bool {
+	return len(r.LocalHosts) > 0 || len(r.Body) > 0
+}
+
+// Request 返回改写后的请求头副本
+// 需要改写响应体时去掉 Accept-Encoding，使本地服务返回未压缩的内容
+func (r *Rewrite) Request(h http.Header) http.Header {
+	h = h.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	r.RequestHeaders.apply(h)
+	if r.rewritesBody() {
+		h.Del("Accept-Encoding")
+	}
+	return h
+}
+
+// Response 改写普通HTTP响应的头部和响应体
+func (r *Rewrite) Response(msg *tunnel.Message, origin PublicOrigin) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string][]string)
+	}
+	header := http.Header(msg.Headers)
+	r.rewriteLocalHosts(header, origin)
+
+	if r.rewritesBody() && len(msg.Body) > 0 && isHTML(header) {
+		body := string(msg.Body)
+		for _, host := range r.LocalHosts {
+			body = replaceOrigins(body, host, origin)
+		}
+		for _, b := range r.Body {
+			body = strings.ReplaceAll(body, b.From, b.To)
+		}
+		msg.Body = []byte(body)
+		header.Del("Content-Length")
+	}
+
+	r.ResponseHeaders.apply(header)
+}
+
+// ResponseHead 只改写响应头，用于 SSE、流式响应和 WebSocket 握手：响应体边收边转发，不做替换
+func (r *Rewrite) ResponseHead(msg *tunnel.Message, origin PublicOrigin) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string][]string)
+	}
+	header := http.Header(msg.Headers)
+	r.rewriteLocalHosts(header, origin)
+	r.ResponseHeaders.apply(header)
+}
+
+// rewriteLocalHosts 指向本地服务的 Location 和 Set-Cookie 的 Domain 改为公网地址
+func (r *Rewrite) rewriteLocalHosts(header http.Header, origin PublicOrigin) {
+	if len(r.LocalHosts) == 0 {
+		return
+	}
+	if loc := header.Get("Location"); loc != "" {
+		header.Set("Location", r.rewriteLocation(loc, origin))
+	}
+	if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+		header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			header.Add("Set-Cookie", r.rewriteCookieDomain(cookie, origin))
+		}
+	}
+}
+
+// rewriteLocation 指向本地服务的重定向改为公网地址；带隧道前缀访问时，站内绝对路径补上前缀
+func (r *Rewrite) rewriteLocation(loc string, origin PublicOrigin) string {
+	for _, host := range r.LocalHosts {
+		for _, local := range []string{"http://" + host, "https://" + host} {
+			if loc == local || strings.HasPrefix(loc, local+"/") || strings.HasPrefix(loc, local+"?") {
+				return origin.String() + strings.TrimPrefix(loc, local)
+			}
+		}
+	}
+	if origin.Prefix != "" && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") && !strings.HasPrefix(loc, origin.Prefix+"/") {
+		return origin.Prefix + loc
+	}
+	return loc
+}
+
+// rewriteCookieDomain Domain 为本地主机名的 Cookie 改为公网主机名
+func (r *Rewrite) rewriteCookieDomain(cookie string, origin PublicOrigin) string {
+	publicHost := origin.Host
+	if h, _, err := net.SplitHostPort(origin.Host); err == nil {
+		publicHost = h
+	}
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(name, "domain") {
+			continue
+		}
+		domain := strings.TrimPrefix(value, ".")
+		for _, host := range r.LocalHosts {
+			localHost := host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				localHost = h
+			}
+			if strings.EqualFold(domain, localHost) {
+				parts[i] = " Domain=" + publicHost
+				break
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// replaceOrigins 将HTML中指向本地服务的绝对链接（含协议相对链接）替换为公网地址
+func replaceOrigins(body, host string, origin PublicOrigin) string {
+	base := origin.String()
+	body = strings.ReplaceAll(body, "http://"+host, base)
+	body = strings.ReplaceAll(body, "https://"+host, base)
+	return strings.ReplaceAll(body, "//"+host, "//"+origin.Host+origin.Prefix)
+}
+
+// isHTML 响应是否为未压缩的HTML
+func isHTML(header http.Header) bool {
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
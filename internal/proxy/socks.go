@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 协议常量
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksNoAcceptable = 0xff
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+
+	socksReplySucceeded      = 0x00
+	socksReplyFailure        = 0x01
+	socksReplyNotAllowed     = 0x02
+	socksReplyCmdUnsupported = 0x07
+)
+
+// ProxyAuthFunc 校验代理用户名和密码
+type ProxyAuthFunc func(username, password string) bool
+
+// ProxyRequest 一次 SOCKS5 或 HTTP CONNECT 请求
+// 调用方拿到目标地址后建立连接，再通过 Accept 或 Reject 回复请求方
+type ProxyRequest struct {
+	Target string // 目标地址 host:port
+
+	conn  net.Conn
+	br    *bufio.Reader
+	socks bool
+}
+
+// ReadProxyRequest 在 conn 上完成 SOCKS5 或 HTTP CONNECT 握手（按首字节区分），返回目标地址
+// auth 为 nil 时不校验用户名密码
+func ReadProxyRequest(conn net.Conn, auth ProxyAuthFunc) (*ProxyRequest, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	req := &ProxyRequest{conn: conn, br: br}
+	if first[0] == socksVersion {
+		req.socks = true
+		err = req.readSocks(auth)
+	} else {
+		err = req.readConnect(auth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// readSocks 处理 SOCKS5 方法协商、用户名密码认证和 CONNECT 请求
+func (r *ProxyRequest) readSocks(auth ProxyAuthFunc) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r.br, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r.br, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksAuthNone)
+	if auth != nil {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		r.conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("SOCKS5 客户端不支持所需的认证方式")
+	}
+	if _, err := r.conn.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+
+	if auth != nil {
+		// RFC 1929 用户名密码认证
+		ver := make([]byte, 2)
+		if _, err := io.ReadFull(r.br, ver); err != nil {
+			return err
+		}
+		username := make([]byte, ver[1])
+		if _, err := io.ReadFull(r.br, username); err != nil {
+			return err
+		}
+		plen, err := r.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		password := make([]byte, plen)
+		if _, err := io.ReadFull(r.br, password); err != nil {
+			return err
+		}
+		if !auth(string(username), string(password)) {
+			r.conn.Write([]byte{0x01, 0x01})
+			return errors.New("SOCKS5 认证失败")
+		}
+		if _, err := r.conn.Write([]byte{0x01, 0x00}); err != nil {
+			return err
+		}
+	}
+
+	// 请求：VER CMD RSV ATYP DST.ADDR DST.PORT
+	reqHeader := make([]byte, 4)
+	if _, err := io.ReadFull(r.br, reqHeader); err != nil {
+		return err
+	}
+	if reqHeader[1] != socksCmdConnect {
+		r.writeSocksReply(socksReplyCmdUnsupported)
+		return fmt.Errorf("不支持的 SOCKS5 命令: %d", reqHeader[1])
+	}
+
+	var host string
+	switch reqHeader[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if reqHeader[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r.br, ip); err != nil {
+			return err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		n, err := r.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(r.br, domain); err != nil {
+			return err
+		}
+		host = string(domain)
+	default:
+		r.writeSocksReply(socksReplyFailure)
+		return fmt.Errorf("不支持的 SOCKS5 地址类型: %d", reqHeader[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r.br, port); err != nil {
+		return err
+	}
+	r.Target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return nil
+}
+
+// readConnect 处理 HTTP CONNECT 请求和 Proxy-Authorization 认证
+func (r *ProxyRequest) readConnect(auth ProxyAuthFunc) error {
+	req, err := http.ReadRequest(r.br)
+	if err != nil {
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		r.writeHTTPStatus(http.StatusMethodNotAllowed, "仅支持 CONNECT 方法")
+		return fmt.Errorf("不支持的代理方法: %s", req.Method)
+	}
+	if auth != nil {
+		username, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+		if !ok || !auth(username, password) {
+			fmt.Fprint(r.conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"tunnel\"\r\nContent-Length: 0\r\n\r\n")
+			return errors.New("HTTP CONNECT 认证失败")
+		}
+	}
+
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	r.Target = target
+	return nil
+}
+
+// Accept 回复请求方连接已建立，返回后续用于转发的连接（包含握手时已缓冲的数据）
+func (r *ProxyRequest) Accept() (net.Conn, error) {
+	var err error
+	if r.socks {
+		err = r.writeSocksReply(socksReplySucceeded)
+	} else {
+		_, err = fmt.Fprint(r.conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedConn{Conn: r.conn, r: r.br}, nil
+}
+
+// Reject 回复请求方连接失败
+// notAllowed 为 true 表示目标被拒绝（SOCKS5 返回 0x02，HTTP 返回 403），否则视为一般失败
+func (r *ProxyRequest) Reject(reason string, notAllowed bool) {
+	if r.socks {
+		code := byte(socksReplyFailure)
+		if notAllowed {
+			code = socksReplyNotAllowed
+		}
+		r.writeSocksReply(code)
+		return
+	}
+	status := http.StatusBadGateway
+	if notAllowed {
+		status = http.StatusForbidden
+	}
+	r.writeHTTPStatus(status, reason)
+}
+
+// writeSocksReply 写入 SOCKS5 回复，绑定地址固定为 0.0.0.0:0
+func (r *ProxyRequest) writeSocksReply(code byte) error {
+	_, err := r.conn.Write([]byte{socksVersion, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// writeHTTPStatus 写入带文本说明的HTTP错误响应
+func (r *ProxyRequest) writeHTTPStatus(status int, reason string) {
+	fmt.Fprintf(r.conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(reason), reason)
+}
+
+// parseProxyAuthorization 解析 Basic 形式的 Proxy-Authorization 头
+func parseProxyAuthorization(header string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// bufferedConn 先读取握手时已缓冲的数据，再读取底层连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -1,120 +1,260 @@
 package proxy
 
 import (
-	"bufio"
-	"fmt"
+	"bytes"
+	"context"
 	"io"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
 )
 
-// HandleSSERequest 处理SSE请求
-func HandleSSERequest(targetURL string, msg *tunnel.Message, tunnelConn *tunnel.Tunnel, writer http.ResponseWriter) error {
-	// 构建目标URL
-	fullURL := targetURL + msg.Path
-	
-	// 创建HTTP请求
-	req, err := http.NewRequest(msg.Method, fullURL, nil)
+// sseChunkSize 客户端读取SSE流的缓冲大小
+const sseChunkSize = 32 * 1024
+
+// hopHeaders 逐跳头，不在隧道两端之间转发
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// HandleSSE 客户端处理SSE请求
+// 先回传上游状态码和响应头，再按原始字节流转发响应体，保持事件之间的空行分隔
+// ctx 被取消（外部调用方已断开）时立即关闭上游连接
+func (u *Upstream) HandleSSE(ctx context.Context, msg *tunnel.Message, tunnelConn *tunnel.Tunnel) {
+	sendError := func(code tunnel.ErrorCode, text string) {
+		tunnelConn.SendMessage(tunnel.NewError(msg.ID, code, text))
+	}
+
+	// 创建HTTP请求（POST 方式的SSE同样需要请求体）
+	req, err := http.NewRequestWithContext(ctx, msg.Method, u.TargetURL+msg.Path, bytes.NewReader(msg.Body))
 	if err != nil {
-		return fmt.Errorf("创建请求失败: %v", err)
+		sendError(tunnel.ErrBadRequest, "创建请求失败: "+err.Error())
+		return
 	}
-	
-	// 设置请求头
+
+	// 设置请求头（包括断线重连时的 Last-Event-ID），HTTP/2 不允许携带逐跳头
+	http2 := u.useHTTP2(msg.Headers)
 	for key, values := range msg.Headers {
+		if http2 && isHopHeader(key) {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(key, value)
 		}
 	}
-	
-	// 设置SSE相关请求头
-	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Cache-Control", "no-cache")
-	
-	// 发送请求
-	client := &http.Client{}
-	resp, err := client.Do(req)
+
+	resp, err := u.httpClient(msg.Headers, true).Do(req)
 	if err != nil {
-		return fmt.Errorf("请求失败: %v", err)
+		sendError(UpstreamErrorCode(err), "请求失败: "+err.Error())
+		return
 	}
 	defer resp.Body.Close()
-	
-	// 设置SSE响应头
-	writer.Header().Set("Content-Type", "text/event-stream")
-	writer.Header().Set("Cache-Control", "no-cache")
-	writer.Header().Set("Connection", "keep-alive")
-	writer.Header().Set("X-Accel-Buffering", "no")
-	
-	// 刷新响应头
-	flusher, ok := writer.(http.Flusher)
-	if !ok {
-		return fmt.Errorf("响应不支持流式传输")
+
+	// 先发送状态码和响应头
+	head := &tunnel.Message{
+		Type:    tunnel.MessageTypeResponse,
+		ID:      msg.ID,
+		Status:  resp.StatusCode,
+		Headers: resp.Header,
 	}
-	flusher.Flush()
-	
-	// 读取SSE流并转发
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// 将SSE数据发送到服务端
-		sseMsg := &tunnel.Message{
-			Type:    tunnel.MessageTypeSSE,
-			ID:      msg.ID,
-			SSEData: line,
+	if err := tunnelConn.SendMessage(head); err != nil {
+		log.Printf("发送SSE响应头失败: %v", err)
+		return
+	}
+
+	// 按原始字节转发，读到多少发多少，不做按行拆分；服务端消费慢时等待其接收窗口
+	window := tunnelConn.NewSendWindow(msg.ID)
+	defer window.Close()
+	buf := make([]byte, sseChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			sseMsg := &tunnel.Message{
+				Type: tunnel.MessageTypeSSE,
+				ID:   msg.ID,
+				Body: data,
+			}
+			if err := window.Send(sseMsg); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("发送SSE数据失败: %v", err)
+				}
+				return
+			}
 		}
-		
-		if err := tunnelConn.SendMessage(sseMsg); err != nil {
-			return fmt.Errorf("发送SSE数据失败: %v", err)
+		if err == io.EOF {
+			tunnelConn.SendMessage(&tunnel.Message{
+				Type: tunnel.MessageTypeSSEEnd,
+				ID:   msg.ID,
+			})
+			return
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// 服务端已取消，无需回传错误
+				return
+			}
+			log.Printf("读取SSE流失败: %v", err)
+			sendError(UpstreamErrorCode(err), "读取SSE流失败: "+err.Error())
+			return
 		}
 	}
-	
-	if err := scanner.Err(); err != nil && err != io.EOF {
-		return fmt.Errorf("读取SSE流失败: %v", err)
-	}
-	
-	return nil
 }
 
-// ForwardSSEToClient 服务端转发SSE到客户端
-func ForwardSSEToClient(writer http.ResponseWriter, tunnelConn *tunnel.Tunnel, requestID string) error {
-	// 设置SSE响应头
-	writer.Header().Set("Content-Type", "text/event-stream")
-	writer.Header().Set("Cache-Control", "no-cache")
-	writer.Header().Set("Connection", "keep-alive")
-	writer.Header().Set("X-Accel-Buffering", "no")
-	
-	flusher, ok := writer.(http.Flusher)
+// ForwardSSE 服务端转发SSE请求并把客户端回传的字节流写给外部调用方
+// 除上游正常结束或报错外，任何原因提前退出都会通知客户端取消该流；收到响应头之前的错误通过 pages 返回
+// rewriteHead 不为 nil 时在写出前改写上游的响应头
+func ForwardSSE(c *gin.Context, tunnelConn *tunnel.Tunnel, msg *tunnel.Message, timeouts Timeouts, pages *ErrorPages, rewriteHead func(*tunnel.Message)) {
+	// 先注册响应通道再发送请求，避免错过客户端的首个响应
+	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
+	defer tunnelConn.UnregisterResponseChan(msg.ID)
+
+	finished := false
+	defer func() {
+		if !finished {
+			tunnelConn.CancelStream(msg.ID)
+		}
+	}()
+
+	if err := tunnelConn.SendMessage(msg); err != nil {
+		finished = true
+		pages.Write(c, tunnel.ErrTunnelDisconnected, "发送请求失败: "+err.Error())
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
-		return fmt.Errorf("响应不支持流式传输")
+		pages.Write(c, tunnel.ErrInternal, "响应不支持流式传输")
+		return
 	}
-	
-	// 监听SSE消息
-	for {
-		msg, err := tunnelConn.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("读取消息失败: %v", err)
+
+	// 等待上游响应头
+	var first *tunnel.Message
+	select {
+	case first = <-responseChan:
+	case <-time.After(timeouts.Forward):
+		pages.Write(c, tunnel.ErrUpstreamTimeout, "请求超时")
+		return
+	case <-c.Request.Context().Done():
+		return
+	case <-tunnelConn.Done():
+		finished = true
+		pages.Write(c, tunnel.ErrTunnelDisconnected, "隧道已断开")
+		return
+	}
+
+	if first.Type == tunnel.MessageTypeError {
+		finished = true
+		pages.Write(c, tunnel.CodeOf(first), first.Error)
+		return
+	}
+
+	// 写入上游状态码和响应头；旧版客户端不发送响应头，直接以SSE数据开始
+	status := http.StatusOK
+	if first.Type == tunnel.MessageTypeResponse {
+		if rewriteHead != nil {
+			rewriteHead(first)
 		}
-		
-		// 检查是否是当前请求的SSE消息
-		if msg.Type == tunnel.MessageTypeSSE && msg.ID == requestID {
-			// 写入SSE数据
-			if _, err := writer.Write([]byte(msg.SSEData + "\n")); err != nil {
-				return fmt.Errorf("写入SSE数据失败: %v", err)
+		for key, values := range first.Headers {
+			if isHopHeader(key) {
+				continue
+			}
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		if first.Status != 0 {
+			status = first.Status
+		}
+	}
+	if c.Writer.Header().Get("Content-Type") == "" {
+		c.Header("Content-Type", "text/event-stream")
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	// SSE是长连接，由 timeouts.sse 控制时长，解除 write_timeout 限制
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Writer.WriteHeader(status)
+	flusher.Flush()
+
+	if first.Type == tunnel.MessageTypeSSE {
+		writeSSEChunk(c.Writer, first)
+		flusher.Flush()
+	}
+
+	timeout := time.NewTimer(timeouts.SSE)
+	defer timeout.Stop()
+	idle := newIdleTracker(timeouts.Idle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-timeout.C:
+			return
+		case <-idle.C():
+			if idle.Expired() {
+				log.Printf("SSE空闲超时: %s", msg.ID)
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-tunnelConn.Done():
+			finished = true
+			return
+		case respMsg := <-responseChan:
+			idle.Touch()
+			switch respMsg.Type {
+			case tunnel.MessageTypeSSE:
+				if err := writeSSEChunk(c.Writer, respMsg); err != nil {
+					return
+				}
+				flusher.Flush()
+			case tunnel.MessageTypeSSEEnd, tunnel.MessageTypeCancel:
+				finished = true
+				return
+			case tunnel.MessageTypeError:
+				finished = true
+				c.Writer.Write([]byte("event: error\ndata: " + respMsg.Error + "\n\n"))
+				flusher.Flush()
+				return
 			}
-			flusher.Flush()
-		} else if msg.Type == tunnel.MessageTypeError && msg.ID == requestID {
-			// 错误消息
-			return fmt.Errorf("SSE错误: %s", msg.Error)
-		} else if msg.Type == tunnel.MessageTypePong {
-			// 心跳响应
-			tunnelConn.UpdatePing()
-			continue
 		}
 	}
 }
 
+// writeSSEChunk 写入一段SSE数据，兼容旧版客户端按行发送的 SSEData
+func writeSSEChunk(w io.Writer, msg *tunnel.Message) error {
+	if len(msg.Body) > 0 {
+		_, err := w.Write(msg.Body)
+		return err
+	}
+	_, err := w.Write([]byte(msg.SSEData + "\n"))
+	return err
+}
+
+// isHopHeader 判断是否为逐跳头
+func isHopHeader(key string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(h, key) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsSSERequest 判断是否是SSE请求
 func IsSSERequest(headers map[string][]string) bool {
 	accept := headers["Accept"]
@@ -130,24 +270,26 @@ func IsSSERequest(headers map[string][]string) bool {
 func IsWebSocketRequest(headers map[string][]string) bool {
 	connection := headers["Connection"]
 	upgrade := headers["Upgrade"]
-	
+
 	hasConnection := false
 	hasUpgrade := false
-	
+
+	// Connection 可能是逗号分隔的列表，如 "keep-alive, Upgrade"
 	for _, val := range connection {
-		if strings.ToLower(val) == "upgrade" {
-			hasConnection = true
-			break
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				hasConnection = true
+				break
+			}
 		}
 	}
-	
+
 	for _, val := range upgrade {
 		if strings.ToLower(val) == "websocket" {
 			hasUpgrade = true
 			break
 		}
 	}
-	
+
 	return hasConnection && hasUpgrade
 }
-
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamChunkSize 流式请求/响应体每条消息的最大字节数
+const streamChunkSize = 32 * 1024
+
+// errStreamClosed 流已被放弃（服务端取消或本地请求结束）
+var errStreamClosed = errors.New("流已关闭")
+
+// IsGRPCRequest 判断是否是gRPC请求（application/grpc 及 application/grpc+proto 等，不含基于HTTP/1.1的 grpc-web）
+func IsGRPCRequest(headers map[string][]string) bool {
+	for _, v := range headers["Content-Type"] {
+		if v == "application/grpc" || strings.HasPrefix(v, "application/grpc+") || strings.HasPrefix(v, "application/grpc;") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStreamRequest 判断请求是否需要双向流式转发：gRPC 请求，或声明了请求 trailers 的请求
+func IsStreamRequest(r *http.Request) bool {
+	return IsGRPCRequest(r.Header) || len(r.Trailer) > 0
+}
+
+// WriteTrailers 写入响应 trailers，需在写完响应体之后、处理函数返回之前调用
+func WriteTrailers(w http.ResponseWriter, trailers map[string][]string) {
+	for key, values := range trailers {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// ForwardStream 服务端以双向流方式转发HTTP请求（gRPC 等）
+// 请求体边读边以 stream_data 发给客户端，响应体同样分段写给外部调用方，最后写入上游的 trailers。
+// 流可能长时间没有响应头（如客户端流式调用），等待响应头和传输过程都只受空闲超时限制；
+// 除上游正常结束或报错外，任何原因提前退出都会通知客户端取消该流；rewriteHead 不为 nil 时在写出前改写上游的响应头
+func ForwardStream(c *gin.Context, tunnelConn *tunnel.Tunnel, msg *tunnel.Message, timeouts Timeouts, pages *ErrorPages, rewriteHead func(*tunnel.Message)) {
+	// 先注册响应通道再发送请求，避免错过客户端的首个响应
+	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
+	defer tunnelConn.UnregisterResponseChan(msg.ID)
+
+	finished := false
+	defer func() {
+		if !finished {
+			tunnelConn.CancelStream(msg.ID)
+		}
+	}()
+
+	// 请求 trailers 需要在发出本地请求前声明
+	for key := range c.Request.Trailer {
+		if msg.Trailers == nil {
+			msg.Trailers = make(map[string][]string)
+		}
+		msg.Trailers[key] = nil
+	}
+	if err := tunnelConn.SendMessage(msg); err != nil {
+		finished = true
+		pages.Write(c, tunnel.ErrTunnelDisconnected, "发送请求失败: "+err.Error())
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		pages.Write(c, tunnel.ErrInternal, "响应不支持流式传输")
+		return
+	}
+
+	// 流是长连接，不受 read_timeout/write_timeout 限制；HTTP/1.1 下允许边读请求体边写响应
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	rc.EnableFullDuplex()
+
+	idle := newIdleTracker(timeouts.Idle)
+	defer idle.Stop()
+	window := tunnelConn.NewSendWindow(msg.ID)
+	defer window.Close()
+	go sendStreamBody(c.Request, tunnelConn, window, msg.ID, idle)
+
+	// 等待上游响应头
+	var head *tunnel.Message
+	for head == nil {
+		select {
+		case head = <-responseChan:
+		case <-idle.C():
+			if idle.Expired() {
+				pages.Write(c, tunnel.ErrUpstreamTimeout, "等待响应超时")
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-tunnelConn.Done():
+			finished = true
+			pages.Write(c, tunnel.ErrTunnelDisconnected, "隧道已断开")
+			return
+		}
+	}
+	if head.Type == tunnel.MessageTypeError {
+		finished = true
+		pages.Write(c, tunnel.CodeOf(head), head.Error)
+		return
+	}
+	idle.Touch()
+
+	if rewriteHead != nil {
+		rewriteHead(head)
+	}
+	for key, values := range head.Headers {
+		if isHopHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			c.Writer.Header().Add(key, value)
+		}
+	}
+	c.Writer.WriteHeader(head.Status)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-idle.C():
+			if idle.Expired() {
+				log.Printf("流空闲超时: %s", msg.ID)
+				writeStreamError(c, tunnel.ErrUpstreamTimeout, "流空闲超时")
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-tunnelConn.Done():
+			finished = true
+			writeStreamError(c, tunnel.ErrTunnelDisconnected, "隧道已断开")
+			return
+		case respMsg := <-responseChan:
+			idle.Touch()
+			switch respMsg.Type {
+			case tunnel.MessageTypeStreamData:
+				if _, err := c.Writer.Write(respMsg.Body); err != nil {
+					return
+				}
+				flusher.Flush()
+			case tunnel.MessageTypeStreamEnd:
+				finished = true
+				WriteTrailers(c.Writer, respMsg.Trailers)
+				return
+			case tunnel.MessageTypeCancel:
+				finished = true
+				return
+			case tunnel.MessageTypeError:
+				finished = true
+				writeStreamError(c, tunnel.CodeOf(respMsg), respMsg.Error)
+				return
+			}
+		}
+	}
+}
+
+// sendStreamBody 边读外部请求体边发送给客户端，读完后发送 stream_end（携带请求 trailers）
+// 客户端的本地服务读取慢时等待其接收窗口；外部调用方断开时直接返回，由 ForwardStream 通知客户端取消
+func sendStreamBody(r *http.Request, tunnelConn *tunnel.Tunnel, window *tunnel.SendWindow, id string, idle *idleTracker) {
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			idle.Touch()
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := window.Send(&tunnel.Message{Type: tunnel.MessageTypeStreamData, ID: id, Body: data}); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			tunnelConn.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeStreamEnd, ID: id, Trailers: r.Trailer})
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamError 响应头已发出后的错误：gRPC 请求以 grpc-status trailer 告知调用方，其余请求只能直接结束响应
+func writeStreamError(c *gin.Context, code tunnel.ErrorCode, message string) {
+	if IsGRPCRequest(c.Request.Header) {
+		WriteTrailers(c.Writer, grpcStatus(code, message))
+	}
+}
+
+// HandleStream 客户端处理双向流式请求
+// 请求体由 body 按服务端发来的顺序提供；先回传上游状态码和响应头，再分段回传响应体，最后回传 trailers。
+// ctx 被取消（服务端发来 cancel）时中止对本地服务的请求
+func (u *Upstream) HandleStream(ctx context.Context, msg *tunnel.Message, body *StreamBody, tunnelConn *tunnel.Tunnel) {
+	defer body.Close()
+	sendError := func(code tunnel.ErrorCode, text string) {
+		tunnelConn.SendMessage(tunnel.NewError(msg.ID, code, text))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, msg.Method, u.TargetURL+msg.Path, body)
+	if err != nil {
+		sendError(tunnel.ErrBadRequest, "创建请求失败: "+err.Error())
+		return
+	}
+	// HTTP/2 不允许携带逐跳头
+	for key, values := range msg.Headers {
+		if isHopHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if len(msg.Trailers) > 0 {
+		req.Trailer = make(http.Header, len(msg.Trailers))
+		for key := range msg.Trailers {
+			req.Trailer[key] = nil
+		}
+		body.trailer = req.Trailer
+	}
+
+	resp, err := u.httpClient(msg.Headers, true).Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			sendError(UpstreamErrorCode(err), "请求失败: "+err.Error())
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	head := &tunnel.Message{
+		Type:    tunnel.MessageTypeResponse,
+		ID:      msg.ID,
+		Status:  resp.StatusCode,
+		Headers: resp.Header,
+	}
+	if err := tunnelConn.SendMessage(head); err != nil {
+		log.Printf("发送流响应头失败: %v", err)
+		return
+	}
+
+	window := tunnelConn.NewSendWindow(msg.ID)
+	defer window.Close()
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := window.Send(&tunnel.Message{Type: tunnel.MessageTypeStreamData, ID: msg.ID, Body: data}); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("发送流数据失败: %v", err)
+				}
+				return
+			}
+		}
+		if err == io.EOF {
+			// trailers 在读完响应体后才可用
+			tunnelConn.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeStreamEnd, ID: msg.ID, Trailers: resp.Trailer})
+			return
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("读取流响应失败: %v", err)
+			sendError(UpstreamErrorCode(err), "读取流响应失败: "+err.Error())
+			return
+		}
+	}
+}
+
+// StreamBody 流式请求的请求体（客户端侧）
+// 会话按顺序写入服务端发来的数据，本地HTTP请求从中读取；结束时把请求 trailers 填入本地请求。
+// 本地请求每读完一段数据即向服务端归还额度，服务端据此控制发送速度
+type StreamBody struct {
+	chunks    chan streamChunk
+	closed    chan struct{}
+	closeOnce sync.Once
+	window    *tunnel.ReceiveWindow
+
+	// 以下字段只由读取方使用
+	buf     []byte
+	ended   bool
+	trailer http.Header // 本地请求声明的 trailers，nil表示没有
+}
+
+// streamChunk 一段请求体，end 为 true 时表示请求体结束
+type streamChunk struct {
+	data     []byte
+	end      bool
+	trailers map[string][]string
+}
+
+// NewStreamBody 创建流式请求体，缓冲大于流量控制窗口
+func NewStreamBody(window *tunnel.ReceiveWindow) *StreamBody {
+	return &StreamBody{
+		chunks: make(chan streamChunk, 2*tunnel.StreamWindow),
+		closed: make(chan struct{}),
+		window: window,
+	}
+}
+
+// Write 排队一段数据，不会等待；缓冲已满（对端未遵守流量控制）时返回 false，调用方应放弃该流
+func (b *StreamBody) Write(data []byte) bool {
+	return b.push(streamChunk{data: data})
+}
+
+// End 请求体结束，缓冲已满时返回 false
+func (b *StreamBody) End(trailers map[string][]string) bool {
+	return b.push(streamChunk{end: true, trailers: trailers})
+}
+
+func (b *StreamBody) push(chunk streamChunk) bool {
+	select {
+	case b.chunks <- chunk:
+		return true
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read 实现 io.Reader
+func (b *StreamBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.ended {
+			return 0, io.EOF
+		}
+		select {
+		case chunk := <-b.chunks:
+			if chunk.end {
+				b.ended = true
+				for key, values := range chunk.trailers {
+					if b.trailer != nil {
+						b.trailer[key] = values
+					}
+				}
+				continue
+			}
+			b.buf = chunk.data
+			b.window.Consumed()
+		case <-b.closed:
+			return 0, errStreamClosed
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Close 放弃请求体，之后的写入被丢弃，读取返回错误
+func (b *StreamBody) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
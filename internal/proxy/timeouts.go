@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"awesomeProject/internal/common"
+)
+
+// Timeouts 代理超时设置
+type Timeouts struct {
+	Forward time.Duration // HTTP请求等待客户端响应
+	Idle    time.Duration // SSE/WebSocket/流式请求空闲超时，0表示不限制
+	SSE     time.Duration // SSE连接最长持续时间
+	Upgrade time.Duration // WebSocket升级等待客户端响应
+}
+
+// TimeoutsFromConfig 将配置（秒）转换为代理超时
+func TimeoutsFromConfig(cfg common.ProxyTimeoutConfig) Timeouts {
+	return Timeouts{
+		Forward: time.Duration(cfg.Forward) * time.Second,
+		Idle:    time.Duration(cfg.Idle) * time.Second,
+		SSE:     time.Duration(cfg.SSE) * time.Second,
+		Upgrade: time.Duration(cfg.Upgrade) * time.Second,
+	}
+}
+
+// TunnelTimeoutsFromConfig 按隧道合并全局与隧道级的超时配置
+func TunnelTimeoutsFromConfig(cfg common.TunnelServerConfig) map[string]Timeouts {
+	tunnels := make(map[string]Timeouts, len(cfg.Tunnels))
+	for id, opts := range cfg.Tunnels {
+		tunnels[id] = TimeoutsFromConfig(cfg.Timeouts.Merge(opts.Timeouts))
+	}
+	return tunnels
+}
+
+// idleTracker 记录流最近一次活动时间，用于空闲超时检测
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64
+	ticker  *time.Ticker
+}
+
+// newIdleTracker 创建空闲检测，timeout为0时永不超时
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.Touch()
+	if timeout > 0 {
+		interval := timeout / 4
+		if interval < time.Second {
+			interval = time.Second
+		}
+		t.ticker = time.NewTicker(interval)
+	}
+	return t
+}
+
+// Touch 记录一次活动
+func (t *idleTracker) Touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// C 返回检测时钟通道，未启用时返回nil（select 中永不就绪）
+func (t *idleTracker) C() <-chan time.Time {
+	if t.ticker == nil {
+		return nil
+	}
+	return t.ticker.C
+}
+
+// Expired 是否已空闲超时
+func (t *idleTracker) Expired() bool {
+	return t.timeout > 0 && time.Since(time.Unix(0, t.last.Load())) > t.timeout
+}
+
+// Stop 停止检测时钟
+func (t *idleTracker) Stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"awesomeProject/internal/common"
+)
+
+// DialFunc 建立到本地服务的连接
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// 访问本地服务使用的HTTP协议
+const (
+	// UpstreamProtocolAuto gRPC 请求使用 HTTP/2，其余使用 HTTP/1.1
+	UpstreamProtocolAuto = "auto"
+	// UpstreamProtocolHTTP1 始终使用 HTTP/1.1
+	UpstreamProtocolHTTP1 = "http1"
+	// UpstreamProtocolHTTP2 HTTP/SSE 请求都使用 HTTP/2（WebSocket 仍使用 HTTP/1.1 升级）
+	UpstreamProtocolHTTP2 = "http2"
+)
+
+// UpstreamOptions 本地服务访问选项
+type UpstreamOptions struct {
+	RequestTimeout time.Duration // 普通HTTP请求超时，0表示使用默认值
+	WSReadLimit    int64         // 本地WebSocket单条消息大小上限，0表示不限制
+	Dial           DialFunc      // HTTP请求的自定义拨号（如进程内管道），nil表示直接拨号
+	// Protocol 访问本地服务的HTTP协议（UpstreamProtocol*），空表示 auto；
+	// HTTP/2 对 http:// 目标使用 h2c（不经TLS直接以HTTP/2连接），对 https:// 目标经TLS协商 h2
+	Protocol string
+}
+
+// Upstream 客户端访问的本地服务，HTTP/SSE/WebSocket 共用同一个连接池和拨号方式
+type Upstream struct {
+	TargetURL string
+
+	dial        DialFunc     // HTTP/SSE/WebSocket
+	tcpDial     DialFunc     // TCP转发，始终直接拨号
+	client      *http.Client // 普通HTTP请求
+	stream      *http.Client // SSE等长连接，不设置整体超时
+	h2          *http.Client // 使用 HTTP/2 的普通HTTP请求
+	h2Stream    *http.Client // 使用 HTTP/2 的流式请求（gRPC 流、SSE）
+	protocol    string
+	wsReadLimit int64
+}
+
+// NewUpstream 创建本地服务访问对象
+func NewUpstream(targetURL string, opts UpstreamOptions) *Upstream {
+	tcpDial := (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	dial := opts.Dial
+	if dial == nil {
+		dial = tcpDial
+	}
+	timeout := opts.RequestTimeout
+	if timeout == 0 {
+		timeout = time.Duration(common.DefaultRequestTimeout) * time.Second
+	}
+
+	// 共用的连接池
+	transport := &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	// HTTP/2 单独使用一个连接池：只开启 HTTP/2 时，http:// 目标才会使用 h2c
+	h2Transport := &http.Transport{
+		DialContext:         dial,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		Protocols:           new(http.Protocols),
+	}
+	h2Transport.Protocols.SetHTTP2(true)
+	h2Transport.Protocols.SetUnencryptedHTTP2(true)
+
+	// 重定向交给外部调用方处理，不在客户端内部跟随
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &Upstream{
+		TargetURL: targetURL,
+		dial:      dial,
+		tcpDial:   tcpDial,
+		client: &http.Client{
+			Transport:     transport,
+			Timeout:       timeout,
+			CheckRedirect: checkRedirect,
+		},
+		stream: &http.Client{
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
+		},
+		h2: &http.Client{
+			Transport:     h2Transport,
+			Timeout:       timeout,
+			CheckRedirect: checkRedirect,
+		},
+		h2Stream: &http.Client{
+			Transport:     h2Transport,
+			CheckRedirect: checkRedirect,
+		},
+		protocol:    opts.Protocol,
+		wsReadLimit: opts.WSReadLimit,
+	}
+}
+
+// useHTTP2 请求是否使用 HTTP/2 访问本地服务
+func (u *Upstream) useHTTP2(headers http.Header) bool {
+	switch u.protocol {
+	case UpstreamProtocolHTTP1:
+		return false
+	case UpstreamProtocolHTTP2:
+		return true
+	default:
+		return IsGRPCRequest(headers)
+	}
+}
+
+// httpClient 按协议选择访问本地服务的 http.Client，streaming 为 true 时不设置整体超时
+func (u *Upstream) httpClient(headers http.Header, streaming bool) *http.Client {
+	switch {
+	case u.useHTTP2(headers) && streaming:
+		return u.h2Stream
+	case u.useHTTP2(headers):
+		return u.h2
+	case streaming:
+		return u.stream
+	default:
+		return u.client
+	}
+}
+
+// DialTCP 建立到本地TCP服务的连接
+func (u *Upstream) DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return u.tcpDial(ctx, "tcp", addr)
+}
+
+// Close 关闭连接池中的空闲连接
+func (u *Upstream) Close() {
+	u.client.CloseIdleConnections()
+	u.h2.CloseIdleConnections()
+}
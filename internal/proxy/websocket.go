@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"awesomeProject/internal/tunnel"
@@ -12,14 +15,27 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 允许所有来源
-	},
+// closeGracePeriod 发出关闭帧后等待对端回应关闭帧的时间
+const closeGracePeriod = 2 * time.Second
+
+// controlWriteTimeout 写入控制帧的超时
+const controlWriteTimeout = 5 * time.Second
+
+// wsHandshakeHeaders 由WebSocket库自行处理的握手头，不直接转发
+var wsHandshakeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
 }
 
 // HandleWebSocketProxy 服务端处理WebSocket代理请求
-func HandleWebSocketProxy(c *gin.Context, tunnelConn *tunnel.Tunnel, requestID string, path string) {
+// readLimit 为外部WebSocket单条消息的大小上限（字节），0表示不限制；升级之前的错误通过 pages 返回；
+// rewriteHead 不为 nil 时改写上游的握手响应头
+func HandleWebSocketProxy(c *gin.Context, tunnelConn *tunnel.Tunnel, requestID string, path string, timeouts Timeouts, readLimit int64, pages *ErrorPages, rewriteHead func(*tunnel.Message)) {
 	// 构建请求消息
 	msg := &tunnel.Message{
 		Type:    tunnel.MessageTypeWebSocket,
@@ -30,196 +46,328 @@ func HandleWebSocketProxy(c *gin.Context, tunnelConn *tunnel.Tunnel, requestID s
 		Body:    nil,
 	}
 
+	// 先注册响应通道再发送请求，避免错过客户端的升级响应
+	responseChan := tunnelConn.RegisterResponseChan(requestID)
+	defer tunnelConn.UnregisterResponseChan(requestID)
+
 	// 发送WebSocket升级请求到客户端
 	err := tunnelConn.SendMessage(msg)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "发送WebSocket请求失败: " + err.Error()})
+		pages.Write(c, tunnel.ErrTunnelDisconnected, "发送WebSocket请求失败: "+err.Error())
 		return
 	}
 
-	// 注册响应通道
-	responseChan := tunnelConn.RegisterResponseChan(requestID)
-	defer tunnelConn.UnregisterResponseChan(requestID)
-
 	// 等待客户端响应（WebSocket升级响应）
-	timeout := time.After(10 * time.Second)
+	timeout := time.After(timeouts.Upgrade)
 	var wsRespMsg *tunnel.Message
 	select {
 	case respMsg := <-responseChan:
 		if respMsg.Type == tunnel.MessageTypeError {
-			c.JSON(500, gin.H{"error": respMsg.Error})
+			pages.Write(c, tunnel.CodeOf(respMsg), respMsg.Error)
 			return
 		}
 		wsRespMsg = respMsg
 	case <-timeout:
-		c.JSON(500, gin.H{"error": "WebSocket升级超时"})
+		tunnelConn.CancelStream(requestID)
+		pages.Write(c, tunnel.ErrUpstreamTimeout, "WebSocket升级超时")
 		return
+	case <-c.Request.Context().Done():
+		tunnelConn.CancelStream(requestID)
+		return
+	case <-tunnelConn.Done():
+		pages.Write(c, tunnel.ErrTunnelDisconnected, "隧道已断开")
+		return
+	}
+
+	if rewriteHead != nil {
+		rewriteHead(wsRespMsg)
 	}
 
-	// 检查响应状态码
-	if wsRespMsg.Status != 101 {
-		c.JSON(wsRespMsg.Status, gin.H{"error": "WebSocket升级失败"})
+	// 检查响应状态码，上游拒绝握手时原样返回状态码和响应体
+	if wsRespMsg.Status != http.StatusSwitchingProtocols {
+		for key, values := range wsRespMsg.Headers {
+			if isHopHeader(key) {
+				continue
+			}
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		if len(wsRespMsg.Body) > 0 {
+			c.Data(wsRespMsg.Status, c.Writer.Header().Get("Content-Type"), wsRespMsg.Body)
+		} else {
+			c.JSON(wsRespMsg.Status, gin.H{"error": "WebSocket升级失败"})
+		}
 		return
 	}
 
-	// 升级当前连接为WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// 按上游的协商结果升级当前连接：子协议、压缩扩展和其余响应头（如 Set-Cookie）
+	respHeaders := http.Header(wsRespMsg.Headers)
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // 允许所有来源
+		},
+		EnableCompression: offersCompression(respHeaders),
+	}
+	if protocol := respHeaders.Get("Sec-Websocket-Protocol"); protocol != "" {
+		upgrader.Subprotocols = []string{protocol}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, filterHandshakeHeaders(respHeaders))
 	if err != nil {
 		log.Printf("WebSocket升级失败: %v", err)
+		tunnelConn.CancelStream(requestID)
 		return
 	}
 	defer conn.Close()
 
-	// 启动双向数据转发
-	done := make(chan struct{})
-
-	// 从外部客户端读取，转发到内网客户端
-	go func() {
-		defer close(done)
-		for {
-			messageType, data, err := conn.ReadMessage()
-			if err != nil {
-				if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket读取错误: %v", err)
-				}
-				return
-			}
-
-			// 发送数据到内网客户端
-			wsDataMsg := &tunnel.Message{
-				Type:          tunnel.MessageTypeWebSocketData,
-				ID:            requestID,
-				WSData:        data,
-				WSMessageType: messageType,
-			}
-			if err := tunnelConn.SendMessage(wsDataMsg); err != nil {
-				log.Printf("发送WebSocket数据失败: %v", err)
-				return
-			}
-		}
-	}()
-
-	// 从内网客户端读取，转发到外部客户端
-	for {
-		select {
-		case <-done:
-			return
-		case respMsg := <-responseChan:
-			if respMsg.Type == tunnel.MessageTypeWebSocketData && respMsg.ID == requestID {
-				// 转发数据到外部客户端
-				if err := conn.WriteMessage(respMsg.WSMessageType, respMsg.WSData); err != nil {
-					log.Printf("写入WebSocket数据失败: %v", err)
-					return
-				}
-			} else if respMsg.Type == tunnel.MessageTypeError && respMsg.ID == requestID {
-				log.Printf("WebSocket错误: %s", respMsg.Error)
-				return
-			}
-		}
-	}
+	idle := newIdleTracker(timeouts.Idle)
+	defer idle.Stop()
+	relayWebSocket(c.Request.Context(), conn, tunnelConn, requestID, responseChan, idle, readLimit)
 }
 
-// HandleClientWebSocket 客户端处理WebSocket请求
-func HandleClientWebSocket(targetURL string, msg *tunnel.Message, tunnelConn *tunnel.Tunnel) {
+// HandleWebSocket 客户端处理WebSocket请求
+// ctx 被取消（服务端发来 cancel）时向本地服务发送关闭帧并结束转发
+func (u *Upstream) HandleWebSocket(ctx context.Context, msg *tunnel.Message, tunnelConn *tunnel.Tunnel) {
 	// 构建目标WebSocket URL
-	wsURL := targetURL + msg.Path
+	wsURL := u.TargetURL + msg.Path
 	// 将 http:// 或 https:// 转换为 ws:// 或 wss://
 	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
 	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
 
-	// 构建请求头
-	headers := make(http.Header)
-	for key, values := range msg.Headers {
-		// 过滤掉一些不应该转发的头
-		if key == "Connection" || key == "Upgrade" || key == "Sec-Websocket-Key" ||
-			key == "Sec-Websocket-Version" || key == "Sec-Websocket-Extensions" ||
-			key == "Sec-Websocket-Protocol" {
-			continue
-		}
-		for _, value := range values {
-			headers.Add(key, value)
-		}
-	}
+	// 构建请求头，握手相关的头交给Dialer按外部客户端的请求重新生成
+	requestHeaders := http.Header(msg.Headers)
+	headers := filterHandshakeHeaders(requestHeaders)
 
-	// 连接到目标WebSocket服务器
-	dialer := websocket.Dialer{}
-	conn, _, err := dialer.Dial(wsURL, headers)
+	// 连接到目标WebSocket服务器，沿用外部客户端请求的子协议和压缩扩展
+	dialer := websocket.Dialer{
+		NetDialContext:    u.dial,
+		HandshakeTimeout:  10 * time.Second,
+		Subprotocols:      websocket.Subprotocols(&http.Request{Header: requestHeaders}),
+		EnableCompression: offersCompression(requestHeaders),
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsURL, headers)
 	if err != nil {
-		errorMsg := &tunnel.Message{
-			Type:  tunnel.MessageTypeError,
-			ID:    msg.ID,
-			Error: "连接WebSocket失败: " + err.Error(),
+		// 上游拒绝握手时回传其状态码，便于外部客户端看到真实原因
+		if resp != nil {
+			responseMsg := &tunnel.Message{
+				Type:    tunnel.MessageTypeResponse,
+				ID:      msg.ID,
+				Status:  resp.StatusCode,
+				Headers: resp.Header,
+			}
+			tunnelConn.SendMessage(responseMsg)
+			return
 		}
-		tunnelConn.SendMessage(errorMsg)
+		tunnelConn.SendMessage(tunnel.NewError(msg.ID, UpstreamErrorCode(err), "连接WebSocket失败: "+err.Error()))
 		return
 	}
 	defer conn.Close()
 
-	// 发送WebSocket升级成功响应
+	// 在回复升级成功前注册通道，避免丢失外部客户端紧接着发来的数据
+	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
+	defer tunnelConn.UnregisterResponseChan(msg.ID)
+
+	// 发送WebSocket升级成功响应，携带协商出的子协议和扩展
 	responseMsg := &tunnel.Message{
-		Type:   tunnel.MessageTypeResponse,
-		ID:     msg.ID,
-		Status: 101, // Switching Protocols
+		Type:    tunnel.MessageTypeResponse,
+		ID:      msg.ID,
+		Status:  http.StatusSwitchingProtocols,
 		Headers: make(map[string][]string),
 	}
-	// 复制响应头（如果需要）
-	responseMsg.Headers["Upgrade"] = []string{"websocket"}
-	responseMsg.Headers["Connection"] = []string{"Upgrade"}
+	for key, values := range resp.Header {
+		responseMsg.Headers[key] = values
+	}
+	if protocol := conn.Subprotocol(); protocol != "" {
+		responseMsg.Headers["Sec-Websocket-Protocol"] = []string{protocol}
+	}
 	tunnelConn.SendMessage(responseMsg)
 
-	// 启动双向数据转发
+	idle := newIdleTracker(0)
+	defer idle.Stop()
+	relayWebSocket(ctx, conn, tunnelConn, msg.ID, responseChan, idle, u.wsReadLimit)
+}
+
+// relayWebSocket 在本端WebSocket连接与隧道之间双向转发
+// 数据帧、ping/pong 控制帧以及关闭帧（含关闭码和原因）都会传递给隧道另一端；
+// 因本端原因（超时、写入失败、ctx取消）结束时，同样向隧道另一端发送关闭帧
+func relayWebSocket(ctx context.Context, conn *websocket.Conn, tunnelConn *tunnel.Tunnel, id string, responseChan chan *tunnel.Message, idle *idleTracker, readLimit int64) {
+	if readLimit > 0 {
+		conn.SetReadLimit(readLimit)
+	}
+	// 隧道另一端消费慢时等待其接收窗口，停止读取本端连接
+	window := tunnelConn.NewSendWindow(id)
+	defer window.Close()
+
+	// ping/pong 不在本端自动应答，而是交给真正的对端处理
+	// 控制帧不经过发送窗口：处理器在读取循环中调用，等待额度会让关闭帧和取消都得不到处理
+	relayControl := func(messageType int) func(string) error {
+		return func(appData string) error {
+			idle.Touch()
+			return tunnelConn.SendMessage(&tunnel.Message{
+				Type:          tunnel.MessageTypeWebSocketData,
+				ID:            id,
+				WSData:        []byte(appData),
+				WSMessageType: messageType,
+			})
+		}
+	}
+	conn.SetPingHandler(relayControl(websocket.PingMessage))
+	conn.SetPongHandler(relayControl(websocket.PongMessage))
+
+	// 对端已发出关闭帧后只需等待本端的回应，不再向隧道重复通知
+	var peerClosed, notified atomic.Bool
+	notifyClose := func(code int, reason string) {
+		if peerClosed.Load() || !notified.CompareAndSwap(false, true) {
+			return
+		}
+		tunnelConn.SendMessage(&tunnel.Message{
+			Type:          tunnel.MessageTypeWebSocketClose,
+			ID:            id,
+			WSCloseCode:   code,
+			WSCloseReason: reason,
+		})
+	}
+	defer notifyClose(websocket.CloseGoingAway, "proxy closed")
 	done := make(chan struct{})
 
-	// 从内网服务读取，转发到服务端
+	// 从本端连接读取，转发到隧道
 	go func() {
 		defer close(done)
 		for {
 			messageType, data, err := conn.ReadMessage()
 			if err != nil {
-				if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				if peerClosed.Load() {
+					return
+				}
+				code, reason := closeStatus(err)
+				if code == websocket.CloseAbnormalClosure {
 					log.Printf("WebSocket读取错误: %v", err)
 				}
+				notifyClose(code, reason)
 				return
 			}
+			idle.Touch()
 
-			// 发送数据到服务端
+			// 发送数据到隧道另一端
 			wsDataMsg := &tunnel.Message{
 				Type:          tunnel.MessageTypeWebSocketData,
-				ID:            msg.ID,
+				ID:            id,
 				WSData:        data,
 				WSMessageType: messageType,
 			}
-			if err := tunnelConn.SendMessage(wsDataMsg); err != nil {
-				log.Printf("发送WebSocket数据失败: %v", err)
+			if err := window.Send(wsDataMsg); err != nil {
+				if !errors.Is(err, tunnel.ErrWindowClosed) {
+					log.Printf("发送WebSocket数据失败: %v", err)
+				}
 				return
 			}
 		}
 	}()
 
-	// 从服务端读取WebSocket数据，转发到内网服务
-	// 通过消息分发器接收数据（在handleRequests中处理）
-	// 这里需要持续监听消息分发器发送的WebSocket数据消息
-	// 由于消息分发器已经在handleRequests中处理，我们需要一个特殊的处理机制
-	// 实际上，WebSocket数据应该通过专门的消息通道传递
-	// 这里我们使用一个goroutine来持续监听responseChan
-	responseChan := tunnelConn.RegisterResponseChan(msg.ID)
-	defer tunnelConn.UnregisterResponseChan(msg.ID)
-
+	// 从隧道读取，转发到本端连接
 	for {
 		select {
 		case <-done:
 			return
+		case <-ctx.Done():
+			peerClosed.Store(true)
+			writeClose(conn, websocket.CloseGoingAway, "")
+			return
+		case <-tunnelConn.Done():
+			peerClosed.Store(true)
+			writeClose(conn, websocket.CloseGoingAway, "tunnel closed")
+			return
+		case <-idle.C():
+			if idle.Expired() {
+				log.Printf("WebSocket空闲超时: %s", id)
+				writeClose(conn, websocket.CloseGoingAway, "idle timeout")
+				return
+			}
 		case respMsg := <-responseChan:
-			if respMsg.Type == tunnel.MessageTypeWebSocketData && respMsg.ID == msg.ID {
-				// 转发数据到内网服务
-				if err := conn.WriteMessage(respMsg.WSMessageType, respMsg.WSData); err != nil {
+			idle.Touch()
+			switch respMsg.Type {
+			case tunnel.MessageTypeWebSocketData:
+				var err error
+				switch respMsg.WSMessageType {
+				case websocket.PingMessage, websocket.PongMessage:
+					err = conn.WriteControl(respMsg.WSMessageType, respMsg.WSData, time.Now().Add(controlWriteTimeout))
+				default:
+					err = conn.WriteMessage(respMsg.WSMessageType, respMsg.WSData)
+				}
+				if err != nil {
 					log.Printf("写入WebSocket数据失败: %v", err)
 					return
 				}
-			} else if respMsg.Type == tunnel.MessageTypeError && respMsg.ID == msg.ID {
+			case tunnel.MessageTypeWebSocketClose:
+				peerClosed.Store(true)
+				if respMsg.WSCloseCode == websocket.CloseAbnormalClosure {
+					// 对端异常断开，同样不发送关闭帧直接断开
+					return
+				}
+				writeClose(conn, respMsg.WSCloseCode, respMsg.WSCloseReason)
+				select {
+				case <-done:
+				case <-time.After(closeGracePeriod):
+				}
+				return
+			case tunnel.MessageTypeCancel:
+				peerClosed.Store(true)
+				writeClose(conn, websocket.CloseGoingAway, "")
+				return
+			case tunnel.MessageTypeError:
 				log.Printf("WebSocket错误: %s", respMsg.Error)
+				writeClose(conn, websocket.CloseInternalServerErr, "")
 				return
 			}
 		}
 	}
 }
+
+// closeStatus 从读取错误中提取关闭码和原因
+func closeStatus(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code, closeErr.Text
+	}
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return websocket.CloseMessageTooBig, "message too big"
+	}
+	return websocket.CloseAbnormalClosure, ""
+}
+
+// writeClose 发送关闭帧
+func writeClose(conn *websocket.Conn, code int, reason string) {
+	data := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(controlWriteTimeout))
+}
+
+// offersCompression 握手头中是否包含 permessage-deflate 扩展
+func offersCompression(headers http.Header) bool {
+	for _, value := range headers.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(strings.ToLower(value), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// filterHandshakeHeaders 去掉握手相关的头，返回可以直接转发的头
+func filterHandshakeHeaders(headers http.Header) http.Header {
+	filtered := make(http.Header)
+	for key, values := range headers {
+		skip := false
+		for _, h := range wsHandshakeHeaders {
+			if strings.EqualFold(h, key) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		for _, value := range values {
+			filtered.Add(key, value)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"awesomeProject/internal/common"
+)
+
+// DefaultCompressionMinSize 默认的压缩阈值（字节）
+const DefaultCompressionMinSize = 1024
+
+// Compression 隧道消息压缩设置
+// 使用 WebSocket permessage-deflate，握手时协商，双方都开启才会生效；
+// 每端只决定自己发送的消息是否压缩，小于阈值或已压缩的内容原样发送
+type Compression struct {
+	Level   int // flate 压缩级别 1-9，0表示默认（1，速度优先）
+	MinSize int // 编码后的消息小于该字节数时不压缩，0表示默认1024
+}
+
+// CompressionFromConfig 将配置转换为压缩设置，未开启时返回 nil
+func CompressionFromConfig(cfg common.CompressionConfig) *Compression {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Compression{Level: cfg.Level, MinSize: cfg.MinSize}
+}
+
+// SetCompression 设置发送消息的压缩策略，nil表示不压缩；需在握手时已协商 permessage-deflate
+func (t *Tunnel) SetCompression(c *Compression) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	t.compression = c
+	if c == nil {
+		t.Conn.EnableWriteCompression(false)
+		return
+	}
+	if c.Level != 0 {
+		t.Conn.SetCompressionLevel(c.Level)
+	}
+}
+
+// shouldCompress 判断消息是否值得压缩
+func (c *Compression) shouldCompress(msg *Message, size int) bool {
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	if size < minSize {
+		return false
+	}
+	if msg.Headers == nil {
+		return true
+	}
+	header := http.Header(msg.Headers)
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	return !IsCompressedContentType(header.Get("Content-Type"))
+}
+
+// IsCompressedContentType 内容类型本身是否已压缩（图片、音视频、压缩包等），再压缩收益很小
+func IsCompressedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "font/woff"):
+		return true
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2",
+		"application/x-xz", "application/pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import "net/http"
+
+// ErrorCode 错误码，随 error 消息一起传递，服务端据此选择对外的HTTP状态码
+type ErrorCode string
+
+const (
+	// ErrTunnelNotFound 隧道不存在或未连接
+	ErrTunnelNotFound ErrorCode = "tunnel_not_found"
+	// ErrTunnelDisconnected 等待响应期间隧道断开
+	ErrTunnelDisconnected ErrorCode = "tunnel_disconnected"
+	// ErrUpstreamUnreachable 客户端无法连接本地服务（拒绝连接、DNS解析失败等）
+	ErrUpstreamUnreachable ErrorCode = "upstream_unreachable"
+	// ErrUpstreamTimeout 本地服务或客户端响应超时
+	ErrUpstreamTimeout ErrorCode = "upstream_timeout"
+	// ErrUpstreamError 本地服务的其他错误（连接中断、读取响应失败等）
+	ErrUpstreamError ErrorCode = "upstream_error"
+	// ErrAuthFailed 认证失败（隧道注册、私有服务密钥）
+	ErrAuthFailed ErrorCode = "auth_failed"
+	// ErrForbidden 不允许的操作（如代理目标不在允许列表中）
+	ErrForbidden ErrorCode = "forbidden"
+	// ErrRateLimited 请求过于频繁
+	ErrRateLimited ErrorCode = "rate_limited"
+	// ErrBadRequest 请求无效
+	ErrBadRequest ErrorCode = "bad_request"
+	// ErrCanceled 请求方已断开
+	ErrCanceled ErrorCode = "canceled"
+	// ErrInternal 其他内部错误
+	ErrInternal ErrorCode = "internal"
+)
+
+// StatusClientClosedRequest 请求方已断开时记录的状态码（沿用 nginx 的 499）
+const StatusClientClosedRequest = 499
+
+// HTTPStatus 返回错误码对应的HTTP状态码
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case ErrTunnelNotFound, ErrTunnelDisconnected:
+		return http.StatusServiceUnavailable
+	case ErrUpstreamUnreachable, ErrUpstreamError:
+		return http.StatusBadGateway
+	case ErrUpstreamTimeout:
+		return http.StatusGatewayTimeout
+	case ErrAuthFailed:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrBadRequest:
+		return http.StatusBadRequest
+	case ErrCanceled:
+		return StatusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCStatus 返回错误码对应的 gRPC 状态码，用于 gRPC 请求的错误响应（grpc-status）
+func (c ErrorCode) GRPCStatus() int {
+	switch c {
+	case ErrTunnelNotFound, ErrTunnelDisconnected, ErrUpstreamUnreachable:
+		return 14 // UNAVAILABLE
+	case ErrUpstreamTimeout:
+		return 4 // DEADLINE_EXCEEDED
+	case ErrAuthFailed:
+		return 16 // UNAUTHENTICATED
+	case ErrForbidden:
+		return 7 // PERMISSION_DENIED
+	case ErrRateLimited:
+		return 8 // RESOURCE_EXHAUSTED
+	case ErrBadRequest:
+		return 3 // INVALID_ARGUMENT
+	case ErrCanceled:
+		return 1 // CANCELLED
+	default:
+		return 13 // INTERNAL
+	}
+}
+
+// NewError 创建带错误码的 error 消息
+func NewError(id string, code ErrorCode, text string) *Message {
+	return &Message{
+		Type:  MessageTypeError,
+		ID:    id,
+		Code:  code,
+		Error: text,
+	}
+}
+
+// CodeOf 返回 error 消息的错误码；旧版本客户端不携带错误码，其错误都来自本地服务，视为 upstream_error
+func CodeOf(msg *Message) ErrorCode {
+	if msg.Code == "" {
+		return ErrUpstreamError
+	}
+	return msg.Code
+}
+
+// Error 带错误码的错误，由 error 消息转换而来
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorOf 将 error 消息转换为 *Error
+func ErrorOf(msg *Message) *Error {
+	return &Error{Code: CodeOf(msg), Message: msg.Error}
+}
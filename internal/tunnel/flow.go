@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// StreamWindow 流量控制窗口：每个流在对端确认消费之前最多发送的数据消息条数
+// 接收方为每个流准备的缓冲不小于窗口，遵守窗口的对端不会让读取循环因缓冲已满而等待
+const StreamWindow = 32
+
+// ErrWindowClosed 流已结束或被对端取消，不再发送数据
+var ErrWindowClosed = errors.New("流已关闭")
+
+// isDataMessage 是否为受流量控制的数据消息
+// WebSocket 的 ping/pong 控制帧不占用窗口，发送方不会因额度用完而延迟它们
+func isDataMessage(msg *Message) bool {
+	switch msg.Type {
+	case MessageTypeSSE, MessageTypeStreamData, MessageTypeTCPData:
+		return true
+	case MessageTypeWebSocketData:
+		return msg.WSMessageType != websocket.PingMessage && msg.WSMessageType != websocket.PongMessage
+	}
+	return false
+}
+
+// SendWindow 一个流的发送窗口
+// 双方都支持流量控制时，数据消息用完额度后等待对端归还（window 消息）：消费慢的流只拖慢自己，
+// 不会占满对端的缓冲而阻塞整条隧道的读取；对端不支持时不限制
+type SendWindow struct {
+	t         *Tunnel
+	id        string
+	credits   chan struct{} // 剩余额度，每条数据消息消耗一个；nil表示不限制
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSendWindow 登记流的发送窗口，流结束时需调用 Close
+func (t *Tunnel) NewSendWindow(id string) *SendWindow {
+	w := &SendWindow{t: t, id: id, closed: make(chan struct{})}
+	if !t.HasCapability(CapabilityFlow) {
+		return w
+	}
+	w.credits = make(chan struct{}, StreamWindow)
+	for range StreamWindow {
+		w.credits <- struct{}{}
+	}
+	t.mu.Lock()
+	t.windows[id] = w
+	t.mu.Unlock()
+	return w
+}
+
+// Send 发送数据消息，额度用完时等待对端归还
+// 窗口已关闭、对端取消该流或隧道关闭时返回 ErrWindowClosed
+func (w *SendWindow) Send(msg *Message) error {
+	select {
+	case <-w.closed:
+		return ErrWindowClosed
+	default:
+	}
+	if w.credits != nil {
+		select {
+		case <-w.credits:
+		case <-w.closed:
+			return ErrWindowClosed
+		case <-w.t.done:
+			return ErrWindowClosed
+		}
+	}
+	return w.t.SendMessage(msg)
+}
+
+// Close 注销窗口，唤醒等待额度的 Send
+func (w *SendWindow) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.t.mu.Lock()
+		if w.t.windows[w.id] == w {
+			delete(w.t.windows, w.id)
+		}
+		w.t.mu.Unlock()
+	})
+}
+
+// sendWindow 返回流已登记的发送窗口
+func (t *Tunnel) sendWindow(id string) *SendWindow {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.windows[id]
+}
+
+// grantWindow 对端归还 n 条额度
+func (t *Tunnel) grantWindow(id string, n int) {
+	w := t.sendWindow(id)
+	if w == nil {
+		return
+	}
+	for range n {
+		select {
+		case w.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// ReceiveWindow 一个流的接收窗口
+// 消费方每处理完一条数据消息调用一次 Consumed，累计半个窗口后向对端归还额度
+type ReceiveWindow struct {
+	t        *Tunnel
+	id       string
+	enabled  bool
+	mu       sync.Mutex
+	consumed int
+}
+
+// NewReceiveWindow 创建流的接收窗口，对端不支持流量控制时 Consumed 什么也不做
+func (t *Tunnel) NewReceiveWindow(id string) *ReceiveWindow {
+	return &ReceiveWindow{t: t, id: id, enabled: t.HasCapability(CapabilityFlow)}
+}
+
+// Consumed 记录一条数据消息已处理
+func (w *ReceiveWindow) Consumed() {
+	if w == nil || !w.enabled {
+		return
+	}
+	w.mu.Lock()
+	w.consumed++
+	n := w.consumed
+	if n < StreamWindow/2 {
+		w.mu.Unlock()
+		return
+	}
+	w.consumed = 0
+	w.mu.Unlock()
+	w.t.SendMessage(&Message{Type: MessageTypeWindow, ID: w.id, Window: n})
+}
@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// 协议版本：注册消息未携带版本号的旧版本客户端/服务端视为版本1
+const (
+	// ProtocolVersion 当前协议版本
+	ProtocolVersion = 2
+	// MinProtocolVersion 仍然兼容的最低协议版本
+	MinProtocolVersion = 1
+)
+
+// 能力：注册时双方交换各自支持的能力，只启用双方都支持的功能；
+// 新增功能时增加能力名称，不必提升协议版本
+const (
+	// CapabilityCancel 支持 cancel 消息
+	CapabilityCancel = "cancel"
+	// CapabilityServices 支持私有TCP服务与访问者（service_register、带 service 的 tcp_init）
+	CapabilityServices = "services"
+	// CapabilityProxy 支持带 target 的 tcp_init（SOCKS5/HTTP CONNECT 出口）
+	CapabilityProxy = "proxy"
+	// CapabilityE2E 支持访问者流的端到端加密
+	CapabilityE2E = "e2e"
+	// CapabilityHealth 支持在心跳中上报本地上游健康状态
+	CapabilityHealth = "health"
+	// CapabilityStream 支持双向流式HTTP请求（stream、stream_data、stream_end），用于 gRPC
+	CapabilityStream = "stream"
+	// CapabilityFlow 支持按流的流量控制（window），数据消息不超过对端的接收窗口
+	CapabilityFlow = "flow"
+)
+
+// Capabilities 本版本支持的全部能力
+var Capabilities = []string{CapabilityCancel, CapabilityServices, CapabilityProxy, CapabilityE2E, CapabilityHealth, CapabilityStream, CapabilityFlow}
+
+// ClientInfo 客户端软件及运行环境信息（注册消息）
+type ClientInfo struct {
+	Version  string `json:"version,omitempty"` // 客户端软件版本
+	OS       string `json:"os,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// LocalClientInfo 返回当前进程的客户端信息
+func LocalClientInfo(version string) *ClientInfo {
+	hostname, _ := os.Hostname()
+	return &ClientInfo{
+		Version:  version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Hostname: hostname,
+	}
+}
+
+// String 返回用于日志的描述，如 "1.2.0 linux/amd64 host"
+func (c *ClientInfo) String() string {
+	parts := make([]string, 0, 3)
+	if c.Version != "" {
+		parts = append(parts, c.Version)
+	}
+	parts = append(parts, c.OS+"/"+c.Arch)
+	if c.Hostname != "" {
+		parts = append(parts, c.Hostname)
+	}
+	return strings.Join(parts, " ")
+}
+
+// PeerVersion 返回消息中的协议版本，未携带时视为版本1
+func PeerVersion(msg *Message) int {
+	if msg.Version == 0 {
+		return 1
+	}
+	return msg.Version
+}
+
+// NegotiateCapabilities 返回双方都支持的能力（排序后）
+func NegotiateCapabilities(local, remote []string) []string {
+	supported := make(map[string]bool, len(local))
+	for _, c := range local {
+		supported[c] = true
+	}
+	var common []string
+	for _, c := range remote {
+		if supported[c] {
+			common = append(common, c)
+			delete(supported, c)
+		}
+	}
+	sort.Strings(common)
+	return common
+}
+
+// SetPeer 记录握手结果：对端的协议版本、双方都支持的能力和客户端信息
+func (t *Tunnel) SetPeer(version int, capabilities []string, client *ClientInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerVersion = version
+	t.capabilities = capabilities
+	t.client = client
+}
+
+// PeerVersion 返回对端的协议版本
+func (t *Tunnel) PeerVersion() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.peerVersion
+}
+
+// Capabilities 返回双方都支持的能力
+func (t *Tunnel) Capabilities() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.capabilities
+}
+
+// HasCapability 双方是否都支持指定能力
+func (t *Tunnel) HasCapability(capability string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, c := range t.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Client 返回客户端信息（服务端侧），旧版本客户端为 nil
+func (t *Tunnel) Client() *ClientInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import "time"
+
+// 本地上游名称，私有服务为 "service:<名称>"（见 ServiceUpstream）
+const (
+	// UpstreamHTTP target_url
+	UpstreamHTTP = "http"
+	// UpstreamTCP tcp_target
+	UpstreamTCP = "tcp"
+)
+
+// ServiceUpstream 返回私有服务对应的上游名称
+func ServiceUpstream(name string) string {
+	return "service:" + name
+}
+
+// UpstreamHealth 客户端本地上游的健康状态，随心跳（pong）上报给服务端
+type UpstreamHealth struct {
+	Name    string    `json:"name"`            // 上游名称：http、tcp 或 service:<名称>
+	Target  string    `json:"target"`          // 检查的地址
+	Healthy bool      `json:"healthy"`         // 是否健康
+	Error   string    `json:"error,omitempty"` // 最近一次检查失败的原因
+	Since   time.Time `json:"since"`           // 进入当前状态的时间
+}
+
+// SetHealth 记录客户端上报的本地上游健康状态（服务端侧）
+func (t *Tunnel) SetHealth(health []UpstreamHealth) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.health = health
+}
+
+// Health 返回客户端最近上报的本地上游健康状态，未开启健康检查时为 nil
+func (t *Tunnel) Health() []UpstreamHealth {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.health
+}
+
+// UpstreamHealthy 指定上游是否健康，未上报的上游视为健康
+// 不健康时返回最近一次检查失败的原因
+func (t *Tunnel) UpstreamHealthy(name string) (bool, string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, h := range t.health {
+		if h.Name == name {
+			return h.Healthy, h.Error
+		}
+	}
+	return true, ""
+}
@@ -4,19 +4,50 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// responseChanSize 响应通道缓冲大小，流式消息（SSE/WebSocket/TCP）依赖缓冲削峰
+const responseChanSize = 64
+
+// responseQueueLimit 每个流尚未送入响应通道的消息上限
+// 遵守流量控制的对端最多积压一个窗口的数据消息，超出说明对端不支持流量控制且消费方跟不上
+const responseQueueLimit = 2 * StreamWindow
+
+// responseChan 已注册的响应通道
+// 分发器只把消息放入队列，由转发协程按顺序送入通道，读取循环不会因某个流的消费方处理慢而等待
+type responseChan struct {
+	ch     chan *Message
+	done   chan struct{} // 注销时关闭，转发协程随之退出
+	wake   chan struct{} // 队列有新消息
+	window *ReceiveWindow
+
+	mu     sync.Mutex
+	queue  []*Message
+	failed bool // 队列超出上限，流已放弃
+}
+
 // Tunnel 隧道连接
 type Tunnel struct {
 	ID            string
 	Conn          *websocket.Conn
 	LastPing      time.Time
-	responseChans map[string]chan *Message // requestID -> response channel
+	responseChans map[string]*responseChan // requestID -> response channel
+	windows       map[string]*SendWindow   // streamID -> 发送窗口
 	mu            sync.RWMutex
+	writeMu       sync.Mutex    // 串行写入连接，与 mu 分开，读取循环不会等待慢的写入
+	done          chan struct{} // 隧道关闭时关闭，等待中的流据此结束
+	closeOnce     sync.Once
+	handler       func(*Message) bool // 未登记响应通道的消息处理器，返回 true 表示已处理
+	compression   *Compression        // 发送消息的压缩策略，nil表示不压缩
+	peerVersion   int                 // 对端协议版本
+	capabilities  []string            // 双方都支持的能力
+	client        *ClientInfo         // 客户端信息（服务端侧）
+	health        []UpstreamHealth    // 客户端上报的本地上游健康状态（服务端侧）
 }
 
 // NewTunnel 创建新的隧道连接
@@ -25,21 +56,49 @@ func NewTunnel(id string, conn *websocket.Conn) *Tunnel {
 		ID:            id,
 		Conn:          conn,
 		LastPing:      time.Now(),
-		responseChans: make(map[string]chan *Message),
+		responseChans: make(map[string]*responseChan),
+		windows:       make(map[string]*SendWindow),
+		done:          make(chan struct{}),
 	}
 }
 
+// Close 关闭隧道连接，并通知所有等待中的流
+func (t *Tunnel) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.Conn.Close()
+	})
+}
+
+// Done 返回隧道关闭通知通道
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// CancelStream 通知隧道另一端放弃指定的流（HTTP/SSE/WebSocket/TCP）
+func (t *Tunnel) CancelStream(id string) error {
+	return t.SendMessage(&Message{
+		Type: MessageTypeCancel,
+		ID:   id,
+	})
+}
+
 // Manager 隧道管理器
 type Manager struct {
-	tunnels  map[string]*Tunnel // tunnelID -> Tunnel
-	mu       sync.RWMutex
-	upgrader websocket.Upgrader
+	tunnels    map[string]*Tunnel // tunnelID -> Tunnel
+	mu         sync.RWMutex
+	upgrader   websocket.Upgrader
+	stop       chan struct{} // Close 时关闭，停止心跳检测
+	stopOnce   sync.Once
+	registered chan struct{} // 有隧道注册时关闭并替换，等待隧道上线的请求据此重新查找
 }
 
 // NewManager 创建隧道管理器
 func NewManager() *Manager {
 	return &Manager{
-		tunnels: make(map[string]*Tunnel),
+		tunnels:    make(map[string]*Tunnel),
+		stop:       make(chan struct{}),
+		registered: make(chan struct{}),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // 允许所有来源
@@ -50,59 +109,55 @@ func NewManager() *Manager {
 
 // RegisterTunnel 注册隧道
 func (m *Manager) RegisterTunnel(tunnelID string, conn *websocket.Conn) *Tunnel {
+	return m.AddTunnel(NewTunnel(tunnelID, conn))
+}
+
+// AddTunnel 注册已完成握手的隧道，注册后即可被请求使用
+func (m *Manager) AddTunnel(tunnel *Tunnel) *Tunnel {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	tunnel := NewTunnel(tunnelID, conn)
+	tunnelID := tunnel.ID
 
 	// 如果已存在，关闭旧连接
 	if oldTunnel, exists := m.tunnels[tunnelID]; exists {
-		oldTunnel.Conn.Close()
+		oldTunnel.Close()
 	}
 
 	m.tunnels[tunnelID] = tunnel
+	close(m.registered)
+	m.registered = make(chan struct{})
 	log.Printf("隧道注册成功: %s", tunnelID)
 	return tunnel
 }
 
-// GetTunnel 获取隧道
-func (m *Manager) GetTunnel(tunnelID string) (*Tunnel, bool) {
+// Registered 返回下一次隧道注册的通知通道（注册时关闭）
+// 先取通道再查找隧道，避免错过两者之间的注册
+func (m *Manager) Registered() <-chan struct{} {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	tunnel, exists := m.tunnels[tunnelID]
-	return tunnel, exists
+	return m.registered
 }
 
-// GetSingleTunnelID 返回当下唯一的隧道ID（仅在只存在一个隧道时可用）
-func (m *Manager) GetSingleTunnelID() (string, bool) {
+// GetTunnel 获取隧道
+func (m *Manager) GetTunnel(tunnelID string) (*Tunnel, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-
-	if len(m.tunnels) != 1 {
-		return "", false
-	}
-
-	for id := range m.tunnels {
-		return id, true
-	}
-
-	return "", false
+	tunnel, exists := m.tunnels[tunnelID]
+	return tunnel, exists
 }
 
-// GetFirstTunnelID 返回第一个可用的隧道ID（如果存在）
-func (m *Manager) GetFirstTunnelID() (string, bool) {
+// TunnelIDs 返回当前所有隧道ID（按ID排序）
+func (m *Manager) TunnelIDs() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if len(m.tunnels) == 0 {
-		return "", false
-	}
-
+	ids := make([]string, 0, len(m.tunnels))
 	for id := range m.tunnels {
-		return id, true
+		ids = append(ids, id)
 	}
-
-	return "", false
+	sort.Strings(ids)
+	return ids
 }
 
 // RemoveTunnel 移除隧道
@@ -110,33 +165,65 @@ func (m *Manager) RemoveTunnel(tunnelID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if tunnel, exists := m.tunnels[tunnelID]; exists {
-		tunnel.Conn.Close()
+		tunnel.Close()
 		delete(m.tunnels, tunnelID)
 		log.Printf("隧道已移除: %s", tunnelID)
 	}
 }
 
+// UnregisterTunnel 移除指定的隧道实例；同ID已被新连接替换时不做处理
+func (m *Manager) UnregisterTunnel(t *Tunnel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.Close()
+	if current, exists := m.tunnels[t.ID]; exists && current == t {
+		delete(m.tunnels, t.ID)
+		log.Printf("隧道已移除: %s", t.ID)
+	}
+}
+
+// Close 停止心跳检测并关闭所有隧道
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, tunnel := range m.tunnels {
+		tunnel.Close()
+		delete(m.tunnels, id)
+	}
+}
+
 // SendMessage 发送消息到隧道（线程安全）
 func (t *Tunnel) SendMessage(msg *Message) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	
+
+	if t.compression != nil {
+		t.Conn.EnableWriteCompression(t.compression.shouldCompress(msg, len(data)))
+	}
 	return t.Conn.WriteMessage(websocket.TextMessage, data)
 }
 
 // RegisterResponseChan 注册响应通道
 func (t *Tunnel) RegisterResponseChan(requestID string) chan *Message {
+	rc := &responseChan{
+		ch:     make(chan *Message, responseChanSize),
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+		window: t.NewReceiveWindow(requestID),
+	}
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.responseChans[requestID] = rc
+	t.mu.Unlock()
 
-	ch := make(chan *Message, 1)
-	t.responseChans[requestID] = ch
-	return ch
+	go t.relay(rc)
+	return rc.ch
 }
 
 // UnregisterResponseChan 注销响应通道
@@ -144,28 +231,93 @@ func (t *Tunnel) UnregisterResponseChan(requestID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if ch, exists := t.responseChans[requestID]; exists {
-		close(ch)
+	if rc, exists := t.responseChans[requestID]; exists {
+		close(rc.done)
 		delete(t.responseChans, requestID)
 	}
 }
 
-// DispatchMessage 分发消息到对应的响应通道
+// DispatchMessage 分发消息到对应的响应通道，不会阻塞
+// 流式消息不能丢弃：队列超出上限时放弃整个流，消费方收到 cancel 结束，并通知对端取消
 func (t *Tunnel) DispatchMessage(msg *Message) {
 	t.mu.RLock()
-	defer t.mu.RUnlock()
+	rc, exists := t.responseChans[msg.ID]
+	t.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	rc.mu.Lock()
+	if rc.failed {
+		rc.mu.Unlock()
+		return
+	}
+	overflow := len(rc.queue) >= responseQueueLimit
+	if overflow {
+		// 尚未送达的消息全部丢弃，消费方下一条即收到 cancel
+		rc.failed = true
+		clear(rc.queue)
+		rc.queue = append(rc.queue[:0], &Message{Type: MessageTypeCancel, ID: msg.ID})
+	} else {
+		rc.queue = append(rc.queue, msg)
+	}
+	rc.mu.Unlock()
 
-	if ch, exists := t.responseChans[msg.ID]; exists {
+	select {
+	case rc.wake <- struct{}{}:
+	default:
+	}
+	if overflow {
+		log.Printf("流 %s 的消费方处理过慢，放弃该流", msg.ID)
+		go t.CancelStream(msg.ID)
+	}
+}
+
+// relay 按顺序把队列中的消息送入响应通道，送达数据消息后向对端归还额度
+func (t *Tunnel) relay(rc *responseChan) {
+	for {
 		select {
-		case ch <- msg:
-		default:
+		case <-rc.wake:
+		case <-rc.done:
+			return
+		case <-t.done:
+			return
+		}
+		for {
+			rc.mu.Lock()
+			if len(rc.queue) == 0 {
+				rc.mu.Unlock()
+				break
+			}
+			msg := rc.queue[0]
+			rc.queue[0] = nil
+			rc.queue = rc.queue[1:]
+			rc.mu.Unlock()
+
+			select {
+			case rc.ch <- msg:
+			case <-rc.done:
+				return
+			case <-t.done:
+				return
+			}
+			if isDataMessage(msg) {
+				rc.window.Consumed()
+			}
 		}
 	}
 }
 
-// StartMessageDispatcher 启动消息分发器
+// SetMessageHandler 设置消息处理器，需在 StartMessageDispatcher 之前调用
+// 分发器在投递到响应通道之前先交给处理器，处理器返回 true 的消息不再分发
+func (t *Tunnel) SetMessageHandler(h func(*Message) bool) {
+	t.handler = h
+}
+
+// StartMessageDispatcher 启动消息分发器，连接断开时关闭隧道
 func (t *Tunnel) StartMessageDispatcher() {
 	go func() {
+		defer t.Close()
 		for {
 			msg, err := t.ReadMessage()
 			if err != nil {
@@ -173,9 +325,16 @@ func (t *Tunnel) StartMessageDispatcher() {
 				return
 			}
 
-			// 处理心跳
+			// 处理心跳，开启健康检查的客户端在心跳中携带本地上游状态
 			if msg.Type == MessageTypePong {
 				t.UpdatePing()
+				if msg.Health != nil {
+					t.SetHealth(msg.Health)
+				}
+				continue
+			}
+
+			if t.handler != nil && t.handler(msg) {
 				continue
 			}
 
@@ -186,19 +345,31 @@ func (t *Tunnel) StartMessageDispatcher() {
 }
 
 // ReadMessage 从隧道读取消息
+// 流量控制消息在此处理，不返回给调用方；对端取消流时同时关闭该流的发送窗口
 func (t *Tunnel) ReadMessage() (*Message, error) {
-	_, data, err := t.Conn.ReadMessage()
-	if err != nil {
-		return nil, err
-	}
+	for {
+		_, data, err := t.Conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
 
-	var msg Message
-	err = json.Unmarshal(data, &msg)
-	if err != nil {
-		return nil, err
-	}
+		var msg Message
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			return nil, err
+		}
 
-	return &msg, nil
+		switch msg.Type {
+		case MessageTypeWindow:
+			t.grantWindow(msg.ID, msg.Window)
+			continue
+		case MessageTypeCancel:
+			if w := t.sendWindow(msg.ID); w != nil {
+				w.Close()
+			}
+		}
+		return &msg, nil
+	}
 }
 
 // UpdatePing 更新心跳时间
@@ -214,7 +385,13 @@ func (m *Manager) StartHeartbeat() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+
 			m.mu.RLock()
 			tunnels := make([]*Tunnel, 0, len(m.tunnels))
 			for _, tunnel := range m.tunnels {
@@ -12,6 +12,8 @@ const (
 	MessageTypeResponse MessageType = "response"
 	// MessageTypeSSE  SSE事件消息（客户端 -> 服务端）
 	MessageTypeSSE MessageType = "sse"
+	// MessageTypeSSEEnd SSE流结束（客户端 -> 服务端）
+	MessageTypeSSEEnd MessageType = "sse_end"
 	// MessageTypeTCPInit TCP连接初始化
 	MessageTypeTCPInit MessageType = "tcp_init"
 	// MessageTypeTCPData TCP数据传输
@@ -22,6 +24,20 @@ const (
 	MessageTypeWebSocket MessageType = "websocket"
 	// MessageTypeWebSocketData WebSocket数据消息
 	MessageTypeWebSocketData MessageType = "websocket_data"
+	// MessageTypeWebSocketClose WebSocket关闭（携带关闭码和原因，双向）
+	MessageTypeWebSocketClose MessageType = "websocket_close"
+	// MessageTypeStream 双向流式HTTP请求（服务端 -> 客户端，gRPC 等），请求体随后以 stream_data 发送
+	MessageTypeStream MessageType = "stream"
+	// MessageTypeStreamData 流式请求/响应体的一段数据（双向）
+	MessageTypeStreamData MessageType = "stream_data"
+	// MessageTypeStreamEnd 流式请求/响应体结束（双向），携带 trailers
+	MessageTypeStreamEnd MessageType = "stream_end"
+	// MessageTypeServiceRegister 发布私有TCP服务（客户端 -> 服务端）
+	MessageTypeServiceRegister MessageType = "service_register"
+	// MessageTypeCancel 取消流（双向），一端的请求方断开或放弃时通知另一端释放资源
+	MessageTypeCancel MessageType = "cancel"
+	// MessageTypeWindow 流量控制：接收方归还发送额度（双向），额度条数见 Window
+	MessageTypeWindow MessageType = "window"
 	// MessageTypeError 错误消息
 	MessageTypeError MessageType = "error"
 	// MessageTypePing 心跳消息
@@ -32,17 +48,29 @@ const (
 
 // Message 通信消息结构
 type Message struct {
-	Type    MessageType          `json:"type"`
-	ID      string               `json:"id,omitempty"`      // 请求ID，用于匹配请求和响应
-	TunnelID string              `json:"tunnel_id,omitempty"` // 隧道ID
-	Method  string               `json:"method,omitempty"`  // HTTP方法
-	Path    string               `json:"path,omitempty"`    // 请求路径
-	Headers map[string][]string `json:"headers,omitempty"` // HTTP头
-	Body    []byte               `json:"body,omitempty"`    // 请求/响应体
-	Status      int    `json:"status,omitempty"`        // HTTP状态码
-	Error       string `json:"error,omitempty"`         // 错误信息
-	SSEData     string `json:"sse_data,omitempty"`      // SSE数据
-	WSData      []byte `json:"ws_data,omitempty"`       // WebSocket数据
-	WSMessageType int  `json:"ws_message_type,omitempty"` // WebSocket消息类型（1=Text, 2=Binary）
+	Type          MessageType         `json:"type"`
+	ID            string              `json:"id,omitempty"`              // 请求ID，用于匹配请求和响应
+	TunnelID      string              `json:"tunnel_id,omitempty"`       // 隧道ID
+	Method        string              `json:"method,omitempty"`          // HTTP方法
+	Path          string              `json:"path,omitempty"`            // 请求路径
+	Headers       map[string][]string `json:"headers,omitempty"`         // HTTP头
+	Body          []byte              `json:"body,omitempty"`            // 请求/响应体
+	Status        int                 `json:"status,omitempty"`          // HTTP状态码
+	Trailers      map[string][]string `json:"trailers,omitempty"`        // HTTP trailers（response、stream_end；stream 中为请求声明的 trailer 名称）
+	Error         string              `json:"error,omitempty"`           // 错误信息
+	Code          ErrorCode           `json:"code,omitempty"`            // 错误码（error 消息）
+	SSEData       string              `json:"sse_data,omitempty"`        // SSE数据（旧版客户端按行发送，新版使用Body传递原始字节流）
+	WSData        []byte              `json:"ws_data,omitempty"`         // WebSocket数据
+	WSMessageType int                 `json:"ws_message_type,omitempty"` // WebSocket消息类型（1=Text, 2=Binary, 9=Ping, 10=Pong）
+	WSCloseCode   int                 `json:"ws_close_code,omitempty"`   // WebSocket关闭码
+	WSCloseReason string              `json:"ws_close_reason,omitempty"` // WebSocket关闭原因
+	Service       string              `json:"service,omitempty"`         // 私有TCP服务名称（service_register、访问者的 tcp_init）
+	Secret        string              `json:"secret,omitempty"`          // 私有TCP服务访问密钥
+	Target        string              `json:"target,omitempty"`          // 代理目标地址 host:port（SOCKS5/HTTP CONNECT 的 tcp_init）
+	Handshake     []byte              `json:"handshake,omitempty"`       // 端到端加密的一次性公钥（访问者的 tcp_init、发布方的 response）
+	Version       int                 `json:"version,omitempty"`         // 协议版本（register 及其响应）
+	Capabilities  []string            `json:"capabilities,omitempty"`    // 支持的能力（register）或双方都支持的能力（register 的响应）
+	Client        *ClientInfo         `json:"client,omitempty"`          // 客户端软件及运行环境（register）
+	Health        []UpstreamHealth    `json:"health,omitempty"`          // 本地上游健康状态（客户端的 pong）
+	Window        int                 `json:"window,omitempty"`          // 归还的发送额度，单位为数据消息条数（window）
 }
-
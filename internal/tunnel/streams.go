@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+)
+
+// StreamRegistry 记录进行中的流及其取消函数
+// 收到 MessageTypeCancel 或隧道断开时，据此中止本地对应的请求
+type StreamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]context.CancelFunc // streamID -> cancel
+}
+
+// NewStreamRegistry 创建流注册表
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{
+		streams: make(map[string]context.CancelFunc),
+	}
+}
+
+// Start 登记一个流，返回其上下文和结束时需要调用的清理函数
+func (r *StreamRegistry) Start(parent context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	r.mu.Lock()
+	r.streams[id] = cancel
+	r.mu.Unlock()
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.streams, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cancel 取消指定的流，返回该流是否存在
+func (r *StreamRegistry) Cancel(id string) bool {
+	r.mu.Lock()
+	cancel, exists := r.streams[id]
+	delete(r.streams, id)
+	r.mu.Unlock()
+
+	if exists {
+		cancel()
+	}
+	return exists
+}
+
+// CancelAll 取消全部流（隧道断开时调用）
+func (r *StreamRegistry) CancelAll() {
+	r.mu.Lock()
+	streams := r.streams
+	r.streams = make(map[string]context.CancelFunc)
+	r.mu.Unlock()
+
+	for _, cancel := range streams {
+		cancel()
+	}
+}
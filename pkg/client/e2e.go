@@ -0,0 +1,137 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// e2eInfo 密钥派生的上下文，协议变化时需要更换
+const e2eInfo = "nat_go e2e v1"
+
+// errE2EMismatch 对端的端到端加密密钥不同或数据被篡改
+var errE2EMismatch = errors.New("端到端加密校验失败（密钥不匹配或数据被篡改）")
+
+// e2eStream 访问者与发布方之间一条TCP流的端到端加密
+// 双方各生成一次性的 X25519 密钥对，经服务端交换公钥后用共享密钥（服务端不知道）派生两个方向的 AES-256-GCM 密钥；
+// 每个 tcp_data 单独加密，nonce 为各方向的递增序号，服务端丢弃、重放或调换顺序都会导致解密失败
+type e2eStream struct {
+	key       string
+	initiator bool // 访问者为发起方
+	local     *ecdh.PrivateKey
+
+	once  sync.Once
+	ready chan struct{} // complete 成功后关闭
+	send  *e2eCipher    // 仅由本地读取协程使用
+	recv  *e2eCipher    // 仅由本地写入协程使用（或在 ready 之前由读取协程校验确认帧）
+}
+
+// e2eCipher 单个方向的加密状态
+type e2eCipher struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+// newE2EStream 生成一次性密钥对
+func newE2EStream(key string, initiator bool) (*e2eStream, error) {
+	local, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eStream{key: key, initiator: initiator, local: local, ready: make(chan struct{})}, nil
+}
+
+// public 返回本方公钥，放入 tcp_init（发起方）或 response（响应方）的 handshake 字段
+func (e *e2eStream) public() []byte {
+	return e.local.PublicKey().Bytes()
+}
+
+// complete 用对端公钥派生两个方向的密钥
+func (e *e2eStream) complete(peer []byte) error {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return errors.New("端到端加密握手无效")
+	}
+	shared, err := e.local.ECDH(peerKey)
+	if err != nil {
+		return errors.New("端到端加密握手无效")
+	}
+
+	// 公钥按发起方、响应方的顺序绑定到派生上下文
+	transcript := append(e.public(), peer...)
+	if !e.initiator {
+		transcript = append(append([]byte{}, peer...), e.public()...)
+	}
+	material, err := hkdf.Key(sha256.New, shared, []byte(e.key), e2eInfo+string(transcript), 64)
+	if err != nil {
+		return err
+	}
+	toResponder, err := newE2ECipher(material[:32])
+	if err != nil {
+		return err
+	}
+	toInitiator, err := newE2ECipher(material[32:])
+	if err != nil {
+		return err
+	}
+
+	e.once.Do(func() {
+		if e.initiator {
+			e.send, e.recv = toResponder, toInitiator
+		} else {
+			e.send, e.recv = toInitiator, toResponder
+		}
+		close(e.ready)
+	})
+	return nil
+}
+
+// isReady 是否已完成握手
+func (e *e2eStream) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// seal 加密一帧
+func (e *e2eStream) seal(plain []byte) []byte {
+	return e.send.aead.Seal(nil, e.send.nonce(), plain, nil)
+}
+
+// open 解密一帧
+func (e *e2eStream) open(sealed []byte) ([]byte, error) {
+	plain, err := e.recv.aead.Open(nil, e.recv.nonce(), sealed, nil)
+	if err != nil {
+		return nil, errE2EMismatch
+	}
+	return plain, nil
+}
+
+func newE2ECipher(key []byte) (*e2eCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eCipher{aead: aead}, nil
+}
+
+// nonce 返回当前序号对应的 nonce 并递增序号
+func (c *e2eCipher) nonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.seq)
+	c.seq++
+	return nonce
+}
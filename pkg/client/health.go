@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/tunnel"
+)
+
+// 健康检查默认值
+const (
+	DefaultHealthCheckTimeout  = 3 * time.Second
+	DefaultHealthCheckFailures = 2
+)
+
+// HealthCheck 本地上游健康检查选项
+// 检查 TargetURL（配置 Path 时发送HTTP请求，否则只检查TCP连接；配置了 Stubs 时不检查）、TCPTarget 和各私有服务的本地地址，
+// 结果随心跳上报给服务端：不健康的上游不再被选中，请求直接返回维护页或 upstream_unreachable
+type HealthCheck struct {
+	Interval time.Duration // 检查间隔
+	Timeout  time.Duration // 单次检查超时，0表示默认3秒
+	Path     string        // HTTP检查路径，如 /healthz；响应状态码为2xx/3xx视为健康
+	Failures int           // 连续失败多少次判定为不健康，0表示默认2次；一次成功即恢复
+}
+
+// UpstreamHealth 本地上游的健康状态
+type UpstreamHealth = tunnel.UpstreamHealth
+
+// healthChecker 定时检查本地上游，状态变化时通知当前会话立即上报
+type healthChecker struct {
+	opts    HealthCheck
+	probes  []*healthProbe
+	changed chan struct{} // 状态变化通知（缓冲1，合并多次变化）
+
+	mu sync.Mutex
+}
+
+// healthProbe 单个本地上游的检查
+type healthProbe struct {
+	check    func(ctx context.Context) error
+	failures int // 连续失败次数
+	checked  bool
+	state    UpstreamHealth
+}
+
+// newHealthChecker 为已配置的本地上游创建检查，没有可检查的上游时返回 nil
+func (c *Client) newHealthChecker(opts HealthCheck) *healthChecker {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultHealthCheckTimeout
+	}
+	if opts.Failures == 0 {
+		opts.Failures = DefaultHealthCheckFailures
+	}
+	h := &healthChecker{opts: opts, changed: make(chan struct{}, 1)}
+
+	dialCheck := func(addr string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			conn, err := c.upstream.DialTCP(ctx, addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	}
+	add := func(name, target string, check func(ctx context.Context) error) {
+		h.probes = append(h.probes, &healthProbe{
+			check: check,
+			state: UpstreamHealth{Name: name, Target: target},
+		})
+	}
+
+	// Handler/Listen 模式在进程内处理请求，无需检查；
+	// 配置了模拟响应时本地服务不可达也由客户端应答，不上报为不健康，否则服务端会直接返回维护页
+	if c.pipe == nil && c.upstream.TargetURL != "" && len(c.stubs) == 0 {
+		if opts.Path != "" {
+			target := c.upstream.TargetURL + opts.Path
+			add(tunnel.UpstreamHTTP, target, httpCheck(target))
+		} else if addr, err := hostPort(c.upstream.TargetURL); err == nil {
+			add(tunnel.UpstreamHTTP, addr, dialCheck(addr))
+		}
+	}
+	if c.opts.TCPTarget != "" {
+		add(tunnel.UpstreamTCP, c.opts.TCPTarget, dialCheck(c.opts.TCPTarget))
+	}
+	for _, svc := range c.opts.Services {
+		add(tunnel.ServiceUpstream(svc.Name), svc.LocalAddr, dialCheck(svc.LocalAddr))
+	}
+	if len(h.probes) == 0 {
+		return nil
+	}
+	return h
+}
+
+// httpCheck 发送 GET 请求，2xx/3xx 视为健康
+func httpCheck(target string) func(ctx context.Context) error {
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "nat_go-health-check")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("状态码 %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// hostPort 返回URL的 host:port，未指定端口时按协议补全
+func hostPort(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// run 立即检查一次，之后按间隔检查，直到 ctx 结束
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll 并发检查全部上游
+func (h *healthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range h.probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+			err := p.check(checkCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			h.record(p, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// record 记录一次检查结果，状态变化时记录日志并通知上报
+func (h *healthChecker) record(p *healthProbe, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	healthy := p.state.Healthy
+	if err == nil {
+		p.failures = 0
+		p.state.Error = ""
+		healthy = true
+	} else {
+		p.failures++
+		p.state.Error = err.Error()
+		// 首次检查失败立即判定，避免启动时误报健康
+		if p.failures >= h.opts.Failures || !p.checked {
+			healthy = false
+		}
+	}
+
+	if p.checked && healthy == p.state.Healthy {
+		return
+	}
+	p.checked = true
+	p.state.Healthy = healthy
+	p.state.Since = time.Now()
+	if healthy {
+		log.Printf("本地服务 %s (%s) 健康检查通过", p.state.Name, p.state.Target)
+	} else {
+		log.Printf("本地服务 %s (%s) 健康检查失败: %s", p.state.Name, p.state.Target, p.state.Error)
+	}
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot 返回已检查过的上游状态
+func (h *healthChecker) snapshot() []UpstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	health := make([]UpstreamHealth, 0, len(h.probes))
+	for _, p := range h.probes {
+		if p.checked {
+			health = append(health, p.state)
+		}
+	}
+	return health
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"net"
+)
+
+// Listener 经隧道到达的连接的监听器
+// HTTP请求（含SSE、WebSocket）以HTTP/1.1原始连接的形式交付，TCP穿透的连接以原始字节流交付，
+// 因此可以直接 http.Serve(l, handler)，无需再监听本地端口
+type Listener struct {
+	client *Client
+}
+
+// Listen 连接服务端并注册隧道，返回的监听器在 Accept 中交付经隧道到达的连接
+// opts 中的 TargetURL、Handler、Listener 会被忽略；未设置 TCPTarget 时TCP穿透的连接同样交付给 Accept
+func Listen(ctx context.Context, opts Options) (*Listener, error) {
+	c, err := newClient(opts, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(ctx); err != nil {
+		return nil, err
+	}
+	return &Listener{client: c}, nil
+}
+
+// Accept 等待下一个经隧道到达的连接
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.client.pipe.Accept()
+}
+
+// Close 关闭监听器并断开隧道
+func (l *Listener) Close() error {
+	return l.client.Close()
+}
+
+// Addr 返回监听地址
+func (l *Listener) Addr() net.Addr {
+	return l.client.pipe.Addr()
+}
+
+// Client 返回底层客户端，可用于查询隧道ID或等待断开
+func (l *Listener) Client() *Client {
+	return l.client
+}
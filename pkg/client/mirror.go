@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+)
+
+// 流量镜像默认值
+const (
+	DefaultMirrorTimeout     = 10 * time.Second
+	DefaultMirrorConcurrency = 64
+)
+
+// Mirror 流量镜像选项
+// 普通HTTP请求在转发给本地服务的同时，按采样比例复制一份发给影子服务（如正在重写的新版本），
+// 影子服务的响应只用于对比，不会返回给外部调用方；SSE、WebSocket 和流式请求不镜像
+type Mirror struct {
+	TargetURL string        // 影子服务地址，如 http://localhost:8081
+	Percent   float64       // 采样百分比，设置 TargetURL 时应大于0且不超过100
+	Diff      bool          // 记录主服务与影子服务状态码或响应体不一致的请求
+	Timeout   time.Duration // 影子请求超时，0表示默认10秒
+}
+
+// mirror 把请求复制发送给影子服务
+type mirror struct {
+	opts     Mirror
+	upstream *proxy.Upstream
+	slots    chan struct{} // 限制同时进行的影子请求，已满时丢弃新的镜像
+}
+
+// newMirror 创建流量镜像，未设置影子服务地址时返回 nil
+// 采样百分比必须明确给出，避免漏填时静默不镜像
+func newMirror(opts Mirror, protocol string) (*mirror, error) {
+	if opts.TargetURL == "" {
+		return nil, nil
+	}
+	if opts.Percent <= 0 || opts.Percent > 100 {
+		return nil, fmt.Errorf("Mirror.Percent 超出范围: %g（应大于0且不超过100）", opts.Percent)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultMirrorTimeout
+	}
+	return &mirror{
+		opts: opts,
+		upstream: proxy.NewUpstream(opts.TargetURL, proxy.UpstreamOptions{
+			RequestTimeout: opts.Timeout,
+			Protocol:       protocol,
+		}),
+		slots: make(chan struct{}, DefaultMirrorConcurrency),
+	}, nil
+}
+
+// start 按采样比例向影子服务发送请求，不等待结果
+// 返回的函数在主请求完成后传入主服务的响应（取消时为 nil），用于对比；未镜像时返回的函数什么也不做
+func (m *mirror) start(msg *tunnel.Message) func(primary *tunnel.Message) {
+	if m == nil || rand.Float64()*100 >= m.opts.Percent {
+		return func(*tunnel.Message) {}
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		log.Printf("影子请求过多，跳过镜像: %s %s", msg.Method, msg.Path)
+		return func(*tunnel.Message) {}
+	}
+
+	primaryChan := make(chan *tunnel.Message, 1)
+	go func() {
+		defer func() { <-m.slots }()
+		// 影子请求独立于主请求，外部调用方断开不影响
+		shadow, _ := m.upstream.HandleRequest(context.Background(), msg)
+		if !m.opts.Diff {
+			return
+		}
+		if primary := <-primaryChan; primary != nil {
+			m.diff(msg, primary, shadow)
+		}
+	}()
+	return func(primary *tunnel.Message) {
+		primaryChan <- primary
+	}
+}
+
+// diff 记录主服务与影子服务响应的差异
+func (m *mirror) diff(msg *tunnel.Message, primary, shadow *tunnel.Message) {
+	if shadow.Type == tunnel.MessageTypeError {
+		log.Printf("镜像差异 %s %s: 影子服务请求失败: %s", msg.Method, msg.Path, shadow.Error)
+		return
+	}
+	if primary.Type == tunnel.MessageTypeError {
+		log.Printf("镜像差异 %s %s: 主服务请求失败: %s，影子服务状态码 %d", msg.Method, msg.Path, primary.Error, shadow.Status)
+		return
+	}
+	if primary.Status != shadow.Status {
+		log.Printf("镜像差异 %s %s: 状态码 %d / %d", msg.Method, msg.Path, primary.Status, shadow.Status)
+		return
+	}
+	if !bytes.Equal(primary.Body, shadow.Body) {
+		log.Printf("镜像差异 %s %s: 响应体 %d / %d 字节，从偏移 %d 处开始不同",
+			msg.Method, msg.Path, len(primary.Body), len(shadow.Body), firstDiff(primary.Body, shadow.Body))
+	}
+}
+
+// firstDiff 返回两段数据第一个不同字节的位置
+func firstDiff(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// close 关闭影子服务的空闲连接
+func (m *mirror) close() {
+	if m != nil {
+		m.upstream.Close()
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// serverState 单个服务端地址的连接状态
+type serverState struct {
+	url           string
+	failures      int       // 连续失败次数，连接成功后清零
+	lastError     string    // 最近一次连接失败或断线的原因
+	lastConnected time.Time // 最近一次注册成功的时间
+	retryAt       time.Time // 失败后的冷却截止时间，之前仅在没有其他可用服务端时尝试
+}
+
+// ServerStatus 单个服务端地址的状态
+type ServerStatus struct {
+	URL           string    `json:"url"`
+	Active        bool      `json:"active"`   // 当前连接的服务端
+	Healthy       bool      `json:"healthy"`  // 不在失败冷却期内
+	Failures      int       `json:"failures"` // 连续失败次数
+	LastError     string    `json:"last_error,omitempty"`
+	LastConnected time.Time `json:"last_connected,omitzero"`
+}
+
+// Status 客户端状态
+type Status struct {
+	TunnelID  string         `json:"tunnel_id"`
+	Connected bool           `json:"connected"`
+	Server    string         `json:"server,omitempty"` // 当前连接的服务端地址
+	Servers   []ServerStatus `json:"servers"`
+
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"` // 本地上游健康检查结果（开启健康检查时）
+}
+
+// serverURLs 合并 ServerURL 与 ServerURLs，按优先级去重
+func serverURLs(opts Options) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, u := range append([]string{opts.ServerURL}, opts.ServerURLs...) {
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// candidates 返回本轮尝试的服务端顺序：上次连接成功的服务端优先，
+// 其余按优先级排列，处于失败冷却期的排在最后
+func (c *Client) candidates() []*serverState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var healthy, cooling []*serverState
+	for i, st := range c.servers {
+		switch {
+		case i == c.lastGood:
+		case now.Before(st.retryAt):
+			cooling = append(cooling, st)
+		default:
+			healthy = append(healthy, st)
+		}
+	}
+	var list []*serverState
+	if c.lastGood >= 0 {
+		list = append(list, c.servers[c.lastGood])
+	}
+	list = append(list, healthy...)
+	return append(list, cooling...)
+}
+
+// connectAny 按 candidates 的顺序逐个连接服务端，返回第一个注册成功的会话
+func (c *Client) connectAny(ctx context.Context) (*session, error) {
+	list := c.candidates()
+	var lastErr error
+	for _, st := range list {
+		s, err := c.connect(ctx, st.url)
+		if err == nil {
+			c.markConnected(st)
+			return s, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.markFailed(st, err)
+		log.Printf("服务端 %s 不可用: %v", st.url, err)
+		lastErr = err
+	}
+	if len(list) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("所有服务端（共 %d 个）均连接失败，最后一次: %w", len(list), lastErr)
+}
+
+// markConnected 记录服务端注册成功，之后重连优先回到该服务端
+func (c *Client) markConnected(st *serverState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, s := range c.servers {
+		if s == st {
+			if c.lastGood != i && len(c.servers) > 1 {
+				log.Printf("已切换到服务端 %s", st.url)
+			}
+			c.lastGood = i
+			c.active = i
+		}
+	}
+	st.failures = 0
+	st.retryAt = time.Time{}
+	st.lastConnected = time.Now()
+}
+
+// markFailed 记录连接失败，服务端进入冷却期
+func (c *Client) markFailed(st *serverState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st.failures++
+	st.lastError = err.Error()
+	st.retryAt = time.Now().Add(c.opts.MaxReconnectDelay)
+}
+
+// markDisconnected 记录当前服务端断线，重连时仍优先尝试该服务端
+func (c *Client) markDisconnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active >= 0 && err != nil {
+		c.servers[c.active].lastError = err.Error()
+	}
+	c.active = -1
+}
+
+// Status 返回客户端及各服务端的连接状态
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	status := Status{
+		TunnelID:  c.tunnelID,
+		Connected: c.active >= 0,
+	}
+	for i, st := range c.servers {
+		if i == c.active {
+			status.Server = st.url
+		}
+		status.Servers = append(status.Servers, ServerStatus{
+			URL:           st.url,
+			Active:        i == c.active,
+			Healthy:       !now.Before(st.retryAt),
+			Failures:      st.failures,
+			LastError:     st.lastError,
+			LastConnected: st.lastConnected,
+		})
+	}
+	if c.health != nil {
+		status.Upstreams = c.health.snapshot()
+	}
+	return status
+}
@@ -0,0 +1,540 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// session 一次到服务端的连接，断线重连时整体替换
+type session struct {
+	client   *Client
+	tunnel   *tunnel.Tunnel
+	streams  *tunnel.StreamRegistry
+	tcpConns sync.Map // connID -> *tcpStream
+	bodies   sync.Map // requestID -> *proxy.StreamBody（双向流式请求的请求体）
+}
+
+func newSession(c *Client, t *tunnel.Tunnel) *session {
+	return &session{
+		client:  c,
+		tunnel:  t,
+		streams: tunnel.NewStreamRegistry(),
+	}
+}
+
+// serve 处理来自服务端的消息，直到连接断开
+// 返回时取消所有进行中的流并关闭本地TCP连接
+func (s *session) serve() error {
+	defer func() {
+		s.tunnel.Close()
+		s.streams.CancelAll()
+		s.tcpConns.Range(func(key, value any) bool {
+			value.(*tcpStream).close()
+			s.tcpConns.Delete(key)
+			return true
+		})
+		s.bodies.Range(func(key, value any) bool {
+			value.(*proxy.StreamBody).Close()
+			s.bodies.Delete(key)
+			return true
+		})
+	}()
+
+	go s.heartbeat()
+
+	for {
+		msg, err := s.tunnel.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket连接关闭: %v", err)
+			}
+			return err
+		}
+
+		switch msg.Type {
+		case tunnel.MessageTypePing:
+			// 处理心跳
+			s.tunnel.SendMessage(&tunnel.Message{
+				Type:     tunnel.MessageTypePong,
+				TunnelID: s.tunnel.ID,
+			})
+			s.tunnel.UpdatePing()
+
+		case tunnel.MessageTypeRequest, tunnel.MessageTypeWebSocket:
+			// 在读取协程中登记，保证随后到达的取消消息能找到该流
+			ctx, done := s.streams.Start(context.Background(), msg.ID)
+			go func() {
+				defer done()
+				s.handleRequest(ctx, msg)
+			}()
+
+		case tunnel.MessageTypeStream:
+			// 在读取协程中登记，随后到达的请求体数据按顺序写入
+			body := proxy.NewStreamBody(s.tunnel.NewReceiveWindow(msg.ID))
+			s.bodies.Store(msg.ID, body)
+			ctx, done := s.streams.Start(context.Background(), msg.ID)
+			go func() {
+				defer done()
+				s.handleStream(ctx, msg, body)
+			}()
+
+		case tunnel.MessageTypeStreamData:
+			// 必须保持顺序，不能开goroutine；写入不会等待，服务端按接收窗口控制发送速度
+			if v, ok := s.bodies.Load(msg.ID); ok && !v.(*proxy.StreamBody).Write(msg.Body) {
+				s.abortStream(msg.ID)
+			}
+
+		case tunnel.MessageTypeStreamEnd:
+			if v, ok := s.bodies.Load(msg.ID); ok && !v.(*proxy.StreamBody).End(msg.Trailers) {
+				s.abortStream(msg.ID)
+			}
+
+		case tunnel.MessageTypeCancel:
+			// 服务端的请求方已断开或放弃
+			s.streams.Cancel(msg.ID)
+			s.closeTCP(msg.ID)
+			if v, ok := s.bodies.LoadAndDelete(msg.ID); ok {
+				v.(*proxy.StreamBody).Close()
+			}
+
+		case tunnel.MessageTypeTCPInit:
+			s.handleTCPInit(msg)
+
+		case tunnel.MessageTypeTCPData:
+			// 必须保持顺序，不能开goroutine
+			s.handleTCPData(msg)
+
+		case tunnel.MessageTypeTCPClose:
+			s.closeTCP(msg.ID)
+
+		case tunnel.MessageTypeWebSocketData, tunnel.MessageTypeWebSocketClose:
+			// WebSocket数据消息通过消息分发器处理
+			s.tunnel.DispatchMessage(msg)
+
+		case tunnel.MessageTypeResponse:
+			if msg.Service != "" {
+				log.Printf("私有服务已发布: %s", msg.Service)
+			} else if v, ok := s.tcpConns.Load(msg.ID); ok {
+				// 发布方已连接本地服务或代理目标
+				s.handleTCPAck(msg, v.(*tcpStream))
+			}
+
+		case tunnel.MessageTypeError:
+			if msg.Service != "" {
+				log.Printf("发布私有服务 %s 失败: %s", msg.Service, msg.Error)
+			} else if v, ok := s.tcpConns.Load(msg.ID); ok {
+				// 访问者连接被拒绝或私有服务连接失败
+				log.Printf("TCP流 %s 失败: %s", msg.ID, msg.Error)
+				v.(*tcpStream).acknowledge(tunnel.ErrorOf(msg))
+				s.closeTCP(msg.ID)
+			}
+		}
+	}
+}
+
+// abortStream 放弃本地服务读取跟不上的双向流，并通知服务端取消
+// 只在服务端未遵守流量控制（不支持的旧版本）时发生
+func (s *session) abortStream(id string) {
+	log.Printf("流 %s 的本地服务读取过慢，放弃该流", id)
+	s.streams.Cancel(id)
+	if v, ok := s.bodies.LoadAndDelete(id); ok {
+		v.(*proxy.StreamBody).Close()
+	}
+	go s.tunnel.CancelStream(id)
+}
+
+// heartbeat 定时发送心跳，连接关闭后退出
+// 开启健康检查且服务端支持时，心跳携带本地上游状态，状态变化时立即上报
+func (s *session) heartbeat() {
+	ticker := time.NewTicker(s.client.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	health := s.client.health
+	if !s.tunnel.HasCapability(tunnel.CapabilityHealth) {
+		health = nil
+	}
+	var changed <-chan struct{}
+	if health != nil {
+		changed = health.changed
+		// 连接建立后立即上报一次，新连接的服务端尚不知道本地上游状态
+		select {
+		case health.changed <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		select {
+		case <-s.tunnel.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+
+		pingMsg := tunnel.Message{
+			Type:     tunnel.MessageTypePong,
+			TunnelID: s.tunnel.ID,
+		}
+		if health != nil {
+			pingMsg.Health = health.snapshot()
+		}
+		if err := s.tunnel.SendMessage(&pingMsg); err != nil {
+			log.Printf("发送心跳失败: %v", err)
+			return
+		}
+	}
+}
+
+// handleRequest 处理单个HTTP/SSE/WebSocket请求
+func (s *session) handleRequest(ctx context.Context, msg *tunnel.Message) {
+	start := time.Now()
+	info := RequestInfo{ID: msg.ID, Method: msg.Method, Path: msg.Path}
+	upstream := s.client.upstream
+
+	switch {
+	case msg.Type == tunnel.MessageTypeWebSocket:
+		info.Kind = "websocket"
+		upstream.HandleWebSocket(ctx, msg, s.tunnel)
+
+	case proxy.IsSSERequest(msg.Headers):
+		info.Kind = "sse"
+		upstream.HandleSSE(ctx, msg, s.tunnel)
+
+	default:
+		info.Kind = "http"
+		compare := s.client.mirror.start(msg)
+		respMsg, err := upstream.HandleRequest(ctx, msg)
+		if ctx.Err() != nil {
+			// 服务端已取消该请求，不再回传结果
+			compare(nil)
+			info.Err = ctx.Err()
+			break
+		}
+		if err != nil {
+			respMsg = tunnel.NewError(msg.ID, proxy.UpstreamErrorCode(err), err.Error())
+		}
+		compare(respMsg)
+		if useStub(respMsg) {
+			if stub := s.client.stubResponse(msg); stub != nil {
+				respMsg = stub
+				info.Stubbed = true
+			}
+		}
+		if respMsg.Type == tunnel.MessageTypeError {
+			info.Err = errors.New(respMsg.Error)
+		}
+		info.Status = respMsg.Status
+
+		// 发送响应
+		if err := s.tunnel.SendMessage(respMsg); err != nil {
+			log.Printf("发送响应失败: %v", err)
+		}
+	}
+
+	info.Duration = time.Since(start)
+	s.client.reportRequest(info)
+}
+
+// handleStream 处理双向流式请求（gRPC 等）
+func (s *session) handleStream(ctx context.Context, msg *tunnel.Message, body *proxy.StreamBody) {
+	start := time.Now()
+	s.client.upstream.HandleStream(ctx, msg, body, s.tunnel)
+	s.bodies.Delete(msg.ID)
+	s.client.reportRequest(RequestInfo{
+		ID:       msg.ID,
+		Kind:     "stream",
+		Method:   msg.Method,
+		Path:     msg.Path,
+		Duration: time.Since(start),
+	})
+}
+
+// tcpStream 一条TCP隧道连接，初始化时即登记，在本地连接建立前到达的数据按顺序缓存
+type tcpStream struct {
+	data      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	confirm   bool       // 代理流：本地连接建立后向对端确认
+	ack       chan error // 访问者代理流：等待对端确认连接结果
+	e2e       *e2eStream // 端到端加密，nil表示明文
+}
+
+func newTCPStream() *tcpStream {
+	return &tcpStream{
+		data:   make(chan []byte, 2*tunnel.StreamWindow),
+		closed: make(chan struct{}),
+	}
+}
+
+// write 排队写入本地连接，不会等待；缓存已满（对端未遵守流量控制）时返回 false
+func (st *tcpStream) write(b []byte) bool {
+	select {
+	case st.data <- b:
+		return true
+	case <-st.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 关闭连接
+func (st *tcpStream) close() {
+	st.closeOnce.Do(func() { close(st.closed) })
+}
+
+// acknowledge 通知等待中的访问者代理流连接结果
+func (st *tcpStream) acknowledge(err error) {
+	if st.ack == nil {
+		return
+	}
+	select {
+	case st.ack <- err:
+	default:
+	}
+}
+
+// handleTCPInit 处理TCP隧道初始化
+// 在读取协程中同步登记，随后的 tcp_data 不会因本地连接尚未建立而丢失
+func (s *session) handleTCPInit(msg *tunnel.Message) {
+	sendError := func(code tunnel.ErrorCode, text string) {
+		s.tunnel.SendMessage(tunnel.NewError(msg.ID, code, text))
+	}
+
+	tcpTarget := s.client.opts.TCPTarget
+	dial := s.client.upstream.DialTCP
+	allow := s.client.proxyAllow
+	if msg.Service != "" {
+		// 访问者经服务端打开的私有服务连接
+		svc, ok := s.client.lookupService(msg.Service)
+		if !ok {
+			sendError(tunnel.ErrBadRequest, "私有服务不存在: "+msg.Service)
+			return
+		}
+		tcpTarget = svc.LocalAddr
+		allow = s.client.serviceAllow[msg.Service]
+	} else if tcpTarget == "" && s.client.listen {
+		// Listen 模式下TCP连接同样交给调用方 Accept
+		tcpTarget = pipeHost
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return s.client.pipe.DialContext(ctx, "tcp", addr)
+		}
+	}
+
+	confirm := false
+	if msg.Target != "" {
+		// SOCKS5/HTTP CONNECT 代理：目标由请求方指定，必须在允许列表内
+		if allow == nil {
+			sendError(tunnel.ErrForbidden, "客户端未开启代理出口")
+			return
+		}
+		tcpTarget = msg.Target
+		dialTCP := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.client.upstream.DialTCP(ctx, addr)
+		}
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return allow.Dial(ctx, dialTCP, addr)
+		}
+		confirm = true
+	}
+	if tcpTarget == "" {
+		sendError(tunnel.ErrBadRequest, "客户端未配置 tcp_target，无法建立TCP隧道")
+		return
+	}
+
+	st := newTCPStream()
+	st.confirm = confirm
+	if msg.Service != "" {
+		// 端到端加密：双方必须同时开启，公钥交换后即可解密访问者随后发送的数据
+		svc, _ := s.client.lookupService(msg.Service)
+		switch {
+		case svc.E2EKey == "" && msg.Handshake != nil:
+			sendError(tunnel.ErrBadRequest, "私有服务未开启端到端加密")
+			return
+		case svc.E2EKey != "" && msg.Handshake == nil:
+			sendError(tunnel.ErrBadRequest, "私有服务要求端到端加密")
+			return
+		case svc.E2EKey != "":
+			e2e, err := newE2EStream(svc.E2EKey, false)
+			if err == nil {
+				err = e2e.complete(msg.Handshake)
+			}
+			if err != nil {
+				sendError(tunnel.ErrBadRequest, err.Error())
+				return
+			}
+			st.e2e = e2e
+		}
+	}
+	s.tcpConns.Store(msg.ID, st)
+	go s.runTCP(msg.ID, st, dial, tcpTarget)
+}
+
+// runTCP 建立本地连接并双向转发，直到任一端关闭
+func (s *session) runTCP(connID string, st *tcpStream, dial func(context.Context, string) (net.Conn, error), tcpTarget string) {
+	start := time.Now()
+	defer func() {
+		s.tcpConns.Delete(connID)
+		st.close()
+		s.client.reportRequest(RequestInfo{ID: connID, Kind: "tcp", Duration: time.Since(start)})
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-st.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	localConn, err := dial(ctx, tcpTarget)
+	cancel()
+	if err != nil {
+		s.tunnel.SendMessage(tunnel.NewError(connID, proxy.UpstreamErrorCode(err), "连接本地TCP失败: "+err.Error()))
+		return
+	}
+	defer localConn.Close()
+
+	if st.confirm || (st.e2e != nil && !st.e2e.initiator) {
+		// 通知请求方连接已建立，代理入口随后回复握手成功；
+		// 端到端加密时附带本方公钥和一个空的加密帧，访问者据此确认密钥一致
+		ack := &tunnel.Message{Type: tunnel.MessageTypeResponse, ID: connID}
+		if st.e2e != nil {
+			ack.Handshake = st.e2e.public()
+			ack.Body = st.e2e.seal(nil)
+		}
+		s.tunnel.SendMessage(ack)
+	}
+
+	// 将本地TCP的数据转发到服务端，服务端消费慢时等待其接收窗口
+	window := s.tunnel.NewSendWindow(connID)
+	defer window.Close()
+	go func() {
+		defer st.close()
+		if st.e2e != nil && !s.waitE2E(st) {
+			s.tunnel.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: connID})
+			return
+		}
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := localConn.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+				if st.e2e != nil {
+					data = st.e2e.seal(data)
+				}
+				dataMsg := &tunnel.Message{
+					Type: tunnel.MessageTypeTCPData,
+					ID:   connID,
+					Body: data,
+				}
+				if err := window.Send(dataMsg); err != nil {
+					if !errors.Is(err, tunnel.ErrWindowClosed) {
+						log.Printf("发送TCP数据失败: %v", err)
+					}
+					break
+				}
+			}
+			if err != nil {
+				closeMsg := &tunnel.Message{
+					Type: tunnel.MessageTypeTCPClose,
+					ID:   connID,
+				}
+				s.tunnel.SendMessage(closeMsg)
+				break
+			}
+		}
+	}()
+
+	// 将服务端的数据按顺序写入本地连接，每写完一段向服务端归还额度
+	received := s.tunnel.NewReceiveWindow(connID)
+	for {
+		select {
+		case b := <-st.data:
+			if st.e2e != nil {
+				var err error
+				if b, err = st.e2e.open(b); err != nil {
+					log.Printf("TCP流 %s: %v", connID, err)
+					s.tunnel.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: connID})
+					return
+				}
+			}
+			if _, err := localConn.Write(b); err != nil {
+				log.Printf("写入本地TCP失败: %v", err)
+				return
+			}
+			received.Consumed()
+		case <-st.closed:
+			return
+		}
+	}
+}
+
+// handleTCPData 将服务端的数据交给对应的TCP连接
+func (s *session) handleTCPData(msg *tunnel.Message) {
+	v, ok := s.tcpConns.Load(msg.ID)
+	if !ok {
+		return
+	}
+	st := v.(*tcpStream)
+	if st.e2e != nil && !st.e2e.isReady() {
+		// 对端未完成端到端加密握手就发送数据（如未开启加密的旧版本发布方）
+		log.Printf("TCP流 %s: 对端未完成端到端加密握手", msg.ID)
+		s.tunnel.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: msg.ID})
+		s.closeTCP(msg.ID)
+		return
+	}
+	if !st.write(msg.Body) {
+		log.Printf("TCP流 %s 的本地连接写入过慢，关闭连接", msg.ID)
+		go s.tunnel.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: msg.ID})
+		s.closeTCP(msg.ID)
+	}
+}
+
+// handleTCPAck 处理发布方的连接确认，端到端加密时完成握手并校验确认帧
+func (s *session) handleTCPAck(msg *tunnel.Message, st *tcpStream) {
+	if st.e2e != nil && !st.e2e.isReady() {
+		err := st.e2e.complete(msg.Handshake)
+		if err == nil {
+			_, err = st.e2e.open(msg.Body)
+		}
+		if err != nil {
+			log.Printf("TCP流 %s: %v", msg.ID, err)
+			st.acknowledge(err)
+			s.tunnel.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: msg.ID})
+			s.closeTCP(msg.ID)
+			return
+		}
+	}
+	st.acknowledge(nil)
+}
+
+// waitE2E 等待端到端加密握手完成，超时或连接关闭时返回 false
+func (s *session) waitE2E(st *tcpStream) bool {
+	select {
+	case <-st.e2e.ready:
+		return true
+	case <-st.closed:
+		return false
+	case <-time.After(proxyHandshakeTimeout):
+		log.Printf("等待端到端加密握手超时")
+		return false
+	}
+}
+
+// closeTCP 关闭TCP连接
+func (s *session) closeTCP(connID string) {
+	if v, ok := s.tcpConns.LoadAndDelete(connID); ok {
+		v.(*tcpStream).close()
+	}
+}
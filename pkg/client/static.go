@@ -0,0 +1,116 @@
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Static 静态文件站点选项
+type Static struct {
+	Dir     string // 站点根目录，如 ./dist
+	Listing bool   // 没有 index.html 的目录是否列出文件，关闭时返回 404
+	SPA     bool   // 单页应用：浏览器访问不存在的路径时返回根目录的 index.html，由前端路由处理
+}
+
+// StaticHandler 返回发布本地目录的 http.Handler，作为 Options.Handler 使用即可经隧道访问，无需另起本地Web服务
+// 支持 Range 请求、If-Modified-Since 和按扩展名的 Content-Type，目录优先返回其中的 index.html；
+// 以 . 开头的文件和目录（如 .git、.env）不对外发布
+func StaticHandler(opts Static) http.Handler {
+	root := staticFS{dir: http.Dir(opts.Dir), listing: opts.Listing}
+	return &staticHandler{
+		root:  root,
+		files: http.FileServer(root),
+		spa:   opts.SPA,
+	}
+}
+
+// staticHandler 静态文件处理，在 http.FileServer 之上增加单页应用回退
+type staticHandler struct {
+	root  http.FileSystem
+	files http.Handler
+	spa   bool
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.spa && h.fallback(r) {
+		r = r.Clone(r.Context())
+		r.URL.Path = "/"
+		r.URL.RawPath = ""
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+// fallback 请求是否应回退到 index.html：浏览器页面请求（Accept 含 text/html）且路径不存在
+// 脚本、图片等资源请求不回退，缺失时仍返回 404
+func (h *staticHandler) fallback(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	f, err := h.root.Open(path.Clean("/" + r.URL.Path))
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	f.Close()
+	return false
+}
+
+// staticFS 隐藏点文件，并按设置禁止列出目录
+type staticFS struct {
+	dir     http.Dir
+	listing bool
+}
+
+// Open 实现 http.FileSystem
+func (s staticFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := s.dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		return f, nil
+	}
+	// 不允许列目录时，没有 index.html 的目录视为不存在
+	if !s.listing {
+		index, err := s.dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return staticDir{f}, nil
+}
+
+// staticDir 列目录时隐藏点文件
+type staticDir struct {
+	http.File
+}
+
+// Readdir 实现 http.File
+func (d staticDir) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"awesomeProject/internal/tunnel"
+)
+
+// Stub 模拟响应
+// 本地服务不可达，或对请求返回 404（尚未实现的接口）时，客户端按顺序查找第一个匹配的模拟响应返回，
+// 而不是返回错误；只作用于普通HTTP请求
+type Stub struct {
+	Method  string            // 请求方法，空表示任意方法
+	Path    string            // 匹配请求路径（不含查询参数）的正则表达式，如 ^/api/orders(/\d+)?$
+	Status  int               // 响应状态码，0表示200
+	Headers map[string]string // 响应头
+	Body    string            // 响应体
+	File    string            // 响应体文件，每次请求时读取（修改后立即生效），优先于 Body；未设置 Content-Type 时按扩展名确定
+}
+
+// stubRule 编译后的模拟响应
+type stubRule struct {
+	Stub
+	path *regexp.Regexp
+}
+
+// compileStubs 编译模拟响应的路径规则
+func compileStubs(stubs []Stub) ([]*stubRule, error) {
+	rules := make([]*stubRule, 0, len(stubs))
+	for i, stub := range stubs {
+		re, err := regexp.Compile(stub.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Stubs[%d].Path 无效: %v", i, err)
+		}
+		rules = append(rules, &stubRule{Stub: stub, path: re})
+	}
+	return rules, nil
+}
+
+// stubResponse 返回请求匹配的模拟响应，没有匹配的规则时返回 nil
+func (c *Client) stubResponse(msg *tunnel.Message) *tunnel.Message {
+	path, _, _ := strings.Cut(msg.Path, "?")
+	for _, rule := range c.stubs {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, msg.Method) {
+			continue
+		}
+		if !rule.path.MatchString(path) {
+			continue
+		}
+		resp, err := rule.response(msg.ID)
+		if err != nil {
+			log.Printf("读取模拟响应失败: %v", err)
+			return nil
+		}
+		return resp
+	}
+	return nil
+}
+
+// response 构建模拟响应消息
+func (r *stubRule) response(id string) (*tunnel.Message, error) {
+	body := []byte(r.Body)
+	if r.File != "" {
+		var err error
+		if body, err = os.ReadFile(r.File); err != nil {
+			return nil, err
+		}
+	}
+
+	headers := make(http.Header, len(r.Headers)+1)
+	for key, value := range r.Headers {
+		headers.Set(key, value)
+	}
+	if headers.Get("Content-Type") == "" && len(body) > 0 {
+		contentType := mime.TypeByExtension(filepath.Ext(r.File))
+		if r.File == "" || contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		headers.Set("Content-Type", contentType)
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &tunnel.Message{
+		Type:    tunnel.MessageTypeResponse,
+		ID:      id,
+		Status:  status,
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// useStub 本地服务的结果是否应由模拟响应代替：本地服务不可达，或返回 404
+func useStub(respMsg *tunnel.Message) bool {
+	if respMsg.Type == tunnel.MessageTypeError {
+		return tunnel.CodeOf(respMsg) == tunnel.ErrUpstreamUnreachable
+	}
+	return respMsg.Status == http.StatusNotFound
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+)
+
+// proxyHandshakeTimeout 代理握手及等待目标连接的超时
+const proxyHandshakeTimeout = 30 * time.Second
+
+// Service 发布的私有TCP服务
+type Service struct {
+	Name      string   // 服务名称（服务端内唯一）
+	Secret    string   // 访问密钥，访问者需持有相同的密钥
+	LocalAddr string   // 本地服务地址，如 127.0.0.1:5432（仅作为代理出口时可为空）
+	Allow     []string // 代理访问者可连接的目标，设置后可作为访问者的 SOCKS5/HTTP CONNECT 出口
+	E2EKey    string   // 端到端加密密钥，设置后只接受使用相同密钥的访问者，服务端只能看到密文
+}
+
+// Visitor 访问者：在本地监听，连接经服务端转发到发布该服务的客户端
+type Visitor struct {
+	Name     string // 要访问的服务名称
+	Secret   string // 访问密钥
+	BindAddr string // 本地监听地址，如 127.0.0.1:15432
+	Proxy    bool   // 本地监听作为 SOCKS5/HTTP CONNECT 代理，目标由发布方连接
+	E2EKey   string // 端到端加密密钥，需与发布方的 Service.E2EKey 相同
+}
+
+// listenVisitors 为每个访问者建立本地监听
+func (c *Client) listenVisitors() error {
+	for _, v := range c.opts.Visitors {
+		ln, err := net.Listen("tcp", v.BindAddr)
+		if err != nil {
+			return fmt.Errorf("访问者 %s 监听 %s 失败: %v", v.Name, v.BindAddr, err)
+		}
+		c.visitorLns = append(c.visitorLns, ln)
+		if v.Proxy {
+			log.Printf("访问者代理已监听 %s（SOCKS5/HTTP CONNECT）-> 私有服务 %s", v.BindAddr, v.Name)
+		} else {
+			log.Printf("访问者已监听 %s -> 私有服务 %s", v.BindAddr, v.Name)
+		}
+		go c.serveVisitor(v, ln)
+	}
+	return nil
+}
+
+// serveVisitor 接受本地连接并经当前隧道打开到私有服务的流，断线期间的连接直接关闭
+func (c *Client) serveVisitor(v Visitor, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		s := c.session
+		c.mu.Unlock()
+		if s == nil || isClosed(s.tunnel) {
+			log.Printf("隧道未连接，拒绝访问者连接 %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if v.Proxy {
+			go s.openVisitorProxy(v, conn)
+		} else {
+			s.openVisitor(v, conn)
+		}
+	}
+}
+
+// openVisitor 为本地连接打开到私有服务的TCP流
+// 先登记再发送初始化消息，服务端回传的数据和错误都能找到该流
+func (s *session) openVisitor(v Visitor, conn net.Conn) {
+	connID := generateStreamID()
+	st := newTCPStream()
+	if err := s.startVisitorStream(connID, st, v, ""); err != nil {
+		conn.Close()
+		return
+	}
+
+	accepted := func(context.Context, string) (net.Conn, error) {
+		return conn, nil
+	}
+	go s.runTCP(connID, st, accepted, v.BindAddr)
+}
+
+// openVisitorProxy 在本地连接上完成 SOCKS5/HTTP CONNECT 握手，再经私有服务的发布方连接目标
+func (s *session) openVisitorProxy(v Visitor, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	req, err := proxy.ReadProxyRequest(conn, nil)
+	if err != nil {
+		log.Printf("代理握手失败 %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	connID := generateStreamID()
+	st := newTCPStream()
+	st.ack = make(chan error, 1)
+	if err := s.startVisitorStream(connID, st, v, req.Target); err != nil {
+		req.Reject(err.Error(), false)
+		conn.Close()
+		return
+	}
+
+	// 等待发布方确认目标已连接
+	select {
+	case err = <-st.ack:
+	case <-st.closed:
+		// 错误消息会先通知再关闭流，优先取出其中的原因
+		select {
+		case err = <-st.ack:
+		default:
+			err = errors.New("连接已关闭")
+		}
+	case <-time.After(proxyHandshakeTimeout):
+		err = errors.New("等待目标连接超时")
+		s.tunnel.CancelStream(connID)
+		s.closeTCP(connID)
+	}
+	if err != nil {
+		var tunnelErr *tunnel.Error
+		notAllowed := errors.As(err, &tunnelErr) && tunnelErr.Code == tunnel.ErrForbidden
+		req.Reject(err.Error(), notAllowed || strings.Contains(err.Error(), common.ErrTargetNotAllowed.Error()))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	local, err := req.Accept()
+	if err != nil {
+		s.tunnel.CancelStream(connID)
+		s.closeTCP(connID)
+		conn.Close()
+		return
+	}
+	accepted := func(context.Context, string) (net.Conn, error) {
+		return local, nil
+	}
+	go s.runTCP(connID, st, accepted, v.BindAddr)
+}
+
+// startVisitorStream 登记流并发送访问者的初始化消息，target 非空时为代理流
+func (s *session) startVisitorStream(connID string, st *tcpStream, v Visitor, target string) error {
+	initMsg := &tunnel.Message{
+		Type:    tunnel.MessageTypeTCPInit,
+		ID:      connID,
+		Service: v.Name,
+		Secret:  v.Secret,
+		Target:  target,
+	}
+	if v.E2EKey != "" {
+		e2e, err := newE2EStream(v.E2EKey, true)
+		if err != nil {
+			return err
+		}
+		st.e2e = e2e
+		initMsg.Handshake = e2e.public()
+	}
+
+	s.tcpConns.Store(connID, st)
+	if err := s.tunnel.SendMessage(initMsg); err != nil {
+		log.Printf("打开私有服务 %s 失败: %v", v.Name, err)
+		s.tcpConns.Delete(connID)
+		return err
+	}
+	return nil
+}
+
+// lookupService 按名称查找发布的私有服务
+func (c *Client) lookupService(name string) (Service, bool) {
+	for _, svc := range c.opts.Services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+	return Service{}, false
+}
+
+// isClosed 隧道是否已关闭
+func isClosed(t *tunnel.Tunnel) bool {
+	select {
+	case <-t.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// generateStreamID 生成访问者连接的流ID
+func generateStreamID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return "visit-" + hex.EncodeToString(bytes)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminPathPrefix 管理接口的路由前缀
+const adminPathPrefix = "/_admin"
+
+// AdminOptions 管理接口选项
+// 接口挂载在 /_admin 下，请求需携带 Authorization: Bearer <Token>：
+//
+//	GET    /_admin/tunnels                 本节点已连接的隧道及其本地上游健康状态
+//	GET    /_admin/tunnels/{隧道ID}        单个隧道
+//	GET    /_admin/tunnels/{隧道ID}/health 隧道上报的本地上游健康状态
+//	GET    /_admin/tunnels/{隧道ID}/cache  隧道是否缓存响应
+//	PUT    /_admin/tunnels/{隧道ID}/cache  开启或关闭隧道的缓存，请求体 {"enabled": true}
+//	DELETE /_admin/tunnels/{隧道ID}/cache  清除隧道缓存的响应
+//	DELETE /_admin/cache                   清除所有隧道缓存的响应（集群模式下只清除本节点）
+type AdminOptions struct {
+	Token string // 访问密钥（必填）
+}
+
+// mountAdmin 注册管理接口
+func (s *Server) mountAdmin(router *gin.Engine) {
+	admin := router.Group(adminPathPrefix, s.adminAuth)
+	admin.GET("/tunnels", s.adminTunnels)
+	admin.GET("/tunnels/:tunnelID", s.adminTunnel)
+	admin.GET("/tunnels/:tunnelID/health", s.adminTunnelHealth)
+	admin.GET("/tunnels/:tunnelID/cache", s.adminCache)
+	admin.PUT("/tunnels/:tunnelID/cache", s.adminSetCache)
+	admin.DELETE("/tunnels/:tunnelID/cache", s.adminPurgeCache)
+	admin.DELETE("/cache", s.adminPurgeCache)
+}
+
+// adminAuth 校验管理接口的访问密钥
+func (s *Server) adminAuth(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Admin.Token)) != 1 {
+		log.Printf("拒绝未认证的管理请求，来自 %s", c.ClientIP())
+		s.writeError(c, tunnel.ErrAuthFailed, "管理接口密钥错误")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// adminTunnels 返回本节点已连接的隧道
+func (s *Server) adminTunnels(c *gin.Context) {
+	tunnels := []TunnelInfo{}
+	for _, id := range s.manager.TunnelIDs() {
+		if info, ok := s.TunnelInfo(id); ok {
+			tunnels = append(tunnels, info)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"tunnels": tunnels})
+}
+
+// adminTunnel 返回单个隧道
+func (s *Server) adminTunnel(c *gin.Context) {
+	info, ok := s.TunnelInfo(c.Param("tunnelID"))
+	if !ok {
+		s.writeError(c, tunnel.ErrTunnelNotFound, "隧道不存在或未连接到本节点")
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// adminTunnelHealth 返回隧道上报的本地上游健康状态，未开启健康检查时 health 为空
+func (s *Server) adminTunnelHealth(c *gin.Context) {
+	info, ok := s.TunnelInfo(c.Param("tunnelID"))
+	if !ok {
+		s.writeError(c, tunnel.ErrTunnelNotFound, "隧道不存在或未连接到本节点")
+		return
+	}
+	health := info.Health
+	if health == nil {
+		health = []UpstreamHealth{}
+	}
+	c.JSON(http.StatusOK, gin.H{"tunnel_id": info.ID, "health": health})
+}
+
+// adminCache 返回隧道是否缓存响应（隧道未连接时同样可以查询和设置）
+func (s *Server) adminCache(c *gin.Context) {
+	tunnelID := c.Param("tunnelID")
+	c.JSON(http.StatusOK, gin.H{"tunnel_id": tunnelID, "enabled": s.CacheEnabled(tunnelID)})
+}
+
+// adminSetCache 开启或关闭隧道的缓存
+func (s *Server) adminSetCache(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		s.writeError(c, tunnel.ErrBadRequest, `请求体应为 {"enabled": true|false}`)
+		return
+	}
+	tunnelID := c.Param("tunnelID")
+	if err := s.SetCacheEnabled(tunnelID, *req.Enabled); err != nil {
+		s.writeError(c, tunnel.ErrBadRequest, err.Error())
+		return
+	}
+	if *req.Enabled {
+		log.Printf("管理接口开启隧道 %s 的响应缓存", tunnelID)
+	} else {
+		log.Printf("管理接口关闭隧道 %s 的响应缓存", tunnelID)
+	}
+	c.JSON(http.StatusOK, gin.H{"tunnel_id": tunnelID, "enabled": *req.Enabled})
+}
+
+// adminPurgeCache 清除隧道缓存的响应，未指定隧道时清除全部
+func (s *Server) adminPurgeCache(c *gin.Context) {
+	tunnelID := c.Param("tunnelID")
+	purged := s.PurgeCache(tunnelID)
+	if tunnelID == "" {
+		log.Printf("管理接口清除全部缓存: %d 条", purged)
+	} else {
+		log.Printf("管理接口清除隧道 %s 的缓存: %d 条", tunnelID, purged)
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
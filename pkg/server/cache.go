@@ -0,0 +1,376 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 响应缓存默认值
+const (
+	DefaultCacheSize      = 256 << 20
+	DefaultCacheEntrySize = 10 << 20
+)
+
+// 响应头 X-Cache 的取值
+const (
+	cacheHit         = "HIT"         // 缓存新鲜，未经过隧道
+	cacheMiss        = "MISS"        // 缓存中没有，从本地服务取得
+	cacheRevalidated = "REVALIDATED" // 缓存过期，本地服务确认未变化（304）
+	cacheStale       = "STALE"       // 重新验证时隧道或本地服务不可用，返回过期的缓存
+)
+
+// CacheOptions 响应缓存选项
+// 只缓存普通HTTP的GET响应（状态码200），遵循 Cache-Control（no-store、private、no-cache、max-age、s-maxage）、
+// Expires 和 Vary；带 Authorization 的请求和带 Set-Cookie 的响应不缓存。
+// 过期的缓存有 ETag/Last-Modified 时经隧道发送条件请求，本地服务返回304则继续使用
+type CacheOptions struct {
+	Store        CacheStore      // 缓存存储，由 NewMemoryCache 或 NewDiskCache 创建
+	Enabled      bool            // 是否默认缓存所有隧道的响应
+	Tunnels      map[string]bool // 按隧道开启或关闭，覆盖 Enabled
+	MaxEntrySize int64           // 单个响应体大小上限（字节），0表示默认10MB
+}
+
+// CacheFromConfig 将配置转换为缓存选项并创建存储
+// 没有任何隧道开启缓存时同样创建存储（内存存储在写入前不占用空间），以便通过管理接口按隧道开启
+func CacheFromConfig(cfg common.TunnelServerConfig) (*CacheOptions, error) {
+	opts := &CacheOptions{
+		Enabled:      cfg.Cache.Enabled,
+		Tunnels:      make(map[string]bool),
+		MaxEntrySize: int64(cfg.Cache.MaxEntrySize) << 20,
+	}
+	for id, t := range cfg.Tunnels {
+		if t.Cache != nil {
+			opts.Tunnels[id] = *t.Cache
+		}
+	}
+
+	maxSize := int64(cfg.Cache.MaxSize) << 20
+	if maxSize == 0 {
+		maxSize = DefaultCacheSize
+	}
+	if cfg.Cache.Dir == "" {
+		opts.Store = NewMemoryCache(maxSize)
+		return opts, nil
+	}
+	store, err := NewDiskCache(cfg.Cache.Dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	opts.Store = store
+	return opts, nil
+}
+
+// cacheEnabled 是否缓存指定隧道的响应，运行时设置的开关优先
+func (s *Server) cacheEnabled(tunnelID string) bool {
+	if s.opts.Cache == nil {
+		return false
+	}
+	s.cacheMu.RLock()
+	enabled, ok := s.cacheTunnels[tunnelID]
+	s.cacheMu.RUnlock()
+	if ok {
+		return enabled
+	}
+	if enabled, ok := s.opts.Cache.Tunnels[tunnelID]; ok {
+		return enabled
+	}
+	return s.opts.Cache.Enabled
+}
+
+// CacheEnabled 返回指定隧道当前是否缓存响应
+func (s *Server) CacheEnabled(tunnelID string) bool {
+	return s.cacheEnabled(tunnelID)
+}
+
+// SetCacheEnabled 运行时开启或关闭指定隧道的缓存，覆盖 CacheOptions 中的设置（重启后失效）
+// 关闭时不清除已缓存的响应，需要时调用 PurgeCache；未配置 Options.Cache 时返回错误
+func (s *Server) SetCacheEnabled(tunnelID string, enabled bool) error {
+	if s.opts.Cache == nil {
+		return errors.New("未配置响应缓存")
+	}
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.cacheTunnels[tunnelID] = enabled
+	return nil
+}
+
+// PurgeCache 清除隧道缓存的全部响应，tunnelID 为空时清除所有隧道，返回清除的条目数
+// 本地服务发布新版本后调用，避免继续返回旧内容
+func (s *Server) PurgeCache(tunnelID string) int {
+	if s.opts.Cache == nil {
+		return 0
+	}
+	return s.opts.Cache.Store.Purge(tunnelID)
+}
+
+// forwardCached 转发普通HTTP请求，开启缓存时优先使用缓存的响应
+func (s *Server) forwardCached(c *gin.Context, tunnelID string, msg *tunnel.Message) (*tunnel.Message, error) {
+	reqHeader := http.Header(msg.Headers)
+	reqCC := cacheControl(reqHeader)
+	if _, noStore := reqCC["no-store"]; noStore || !s.cacheEnabled(tunnelID) ||
+		msg.Method != http.MethodGet || reqHeader.Get("Authorization") != "" {
+		return s.forward(c, tunnelID, msg)
+	}
+
+	resp, err := s.cachedResponse(c, tunnelID, msg, reqCC)
+	if err != nil {
+		return nil, err
+	}
+	// 外部调用方的条件请求由服务端根据最终响应判断
+	if notModified(reqHeader, resp) {
+		header := http.Header(resp.Headers).Clone()
+		header.Del("Content-Length")
+		resp = &tunnel.Message{Type: resp.Type, ID: resp.ID, Status: http.StatusNotModified, Headers: header}
+	}
+	return resp, nil
+}
+
+// cachedResponse 查找缓存：新鲜时直接返回，过期时经隧道重新验证，未命中时转发并按响应头决定是否缓存
+func (s *Server) cachedResponse(c *gin.Context, tunnelID string, msg *tunnel.Message, reqCC map[string]string) (*tunnel.Message, error) {
+	store := s.opts.Cache.Store
+	reqHeader := http.Header(msg.Headers)
+	key := c.Request.Host + msg.Path
+	now := time.Now()
+
+	entry, cached := store.Get(tunnelID, key)
+	if cached && !entry.matches(reqHeader) {
+		cached = false
+	}
+	if cached && now.Before(entry.Expires) && !revalidateRequested(reqHeader, reqCC) {
+		return entry.message(msg.ID, cacheHit, now), nil
+	}
+
+	// 去掉外部调用方的条件头，缓存过期时换成缓存的校验值
+	forwarded := *msg
+	header := reqHeader.Clone()
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		header.Del(name)
+	}
+	if cached {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	forwarded.Headers = header
+
+	resp, err := s.forward(c, tunnelID, &forwarded)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		if resp.Type == tunnel.MessageTypeResponse && resp.Status == http.StatusNotModified {
+			entry = entry.revalidated(http.Header(resp.Headers), now)
+			store.Put(tunnelID, key, entry)
+			return entry.message(msg.ID, cacheRevalidated, now), nil
+		}
+		if resp.Type == tunnel.MessageTypeError && entry.staleAllowed() {
+			switch tunnel.CodeOf(resp) {
+			case tunnel.ErrTunnelDisconnected, tunnel.ErrUpstreamUnreachable, tunnel.ErrUpstreamTimeout:
+				return entry.message(msg.ID, cacheStale, now), nil
+			}
+		}
+	}
+	if resp.Type != tunnel.MessageTypeResponse {
+		return resp, nil
+	}
+
+	if entry := s.newCacheEntry(reqHeader, resp, now); entry != nil {
+		store.Put(tunnelID, key, entry)
+	}
+	if resp.Headers == nil {
+		resp.Headers = make(map[string][]string)
+	}
+	http.Header(resp.Headers).Set("X-Cache", cacheMiss)
+	return resp, nil
+}
+
+// newCacheEntry 响应可以缓存时创建缓存条目，否则返回 nil
+func (s *Server) newCacheEntry(reqHeader http.Header, resp *tunnel.Message, now time.Time) *CacheEntry {
+	maxEntrySize := s.opts.Cache.MaxEntrySize
+	if maxEntrySize == 0 {
+		maxEntrySize = DefaultCacheEntrySize
+	}
+	header := http.Header(resp.Headers)
+	cc := cacheControl(header)
+	_, noStore := cc["no-store"]
+	_, private := cc["private"]
+	if resp.Status != http.StatusOK || noStore || private || int64(len(resp.Body)) > maxEntrySize ||
+		header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	vary := make(map[string]string)
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[name] = reqHeader.Get(name)
+			}
+		}
+	}
+
+	lifetime := freshness(header, now)
+	// 既不新鲜又无法重新验证的响应缓存了也用不上
+	if lifetime <= 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return nil
+	}
+	return &CacheEntry{
+		Status:  resp.Status,
+		Header:  header.Clone(),
+		Body:    resp.Body,
+		Stored:  now,
+		Expires: now.Add(lifetime),
+		Vary:    vary,
+	}
+}
+
+// matches 请求在 Vary 列出的头部上与缓存时的请求一致
+func (e *CacheEntry) matches(reqHeader http.Header) bool {
+	for name, value := range e.Vary {
+		if reqHeader.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// staleAllowed 响应是否允许在无法重新验证时过期使用
+func (e *CacheEntry) staleAllowed() bool {
+	cc := cacheControl(e.Header)
+	_, must := cc["must-revalidate"]
+	_, proxy := cc["proxy-revalidate"]
+	_, sMaxAge := cc["s-maxage"]
+	return !must && !proxy && !sMaxAge
+}
+
+// revalidated 用304响应的头部更新缓存，返回新的条目（缓存中的条目可能正被其他请求读取）
+func (e *CacheEntry) revalidated(header http.Header, now time.Time) *CacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.Stored = now
+	updated.Expires = now.Add(freshness(updated.Header, now))
+	return &updated
+}
+
+// message 用缓存的响应构造响应消息
+func (e *CacheEntry) message(id, status string, now time.Time) *tunnel.Message {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.Stored).Seconds())))
+	header.Set("X-Cache", status)
+	return &tunnel.Message{
+		Type:    tunnel.MessageTypeResponse,
+		ID:      id,
+		Status:  e.Status,
+		Headers: header,
+		Body:    e.Body,
+	}
+}
+
+// freshness 按 Cache-Control（s-maxage 优先于 max-age）或 Expires 计算剩余的新鲜期，no-cache 的响应每次都要重新验证
+func freshness(header http.Header, now time.Time) time.Duration {
+	cc := cacheControl(header)
+	if _, noCache := cc["no-cache"]; noCache {
+		return 0
+	}
+	age := time.Duration(0)
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds)*time.Second - age
+		}
+	}
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date) - age
+	}
+	return 0
+}
+
+// revalidateRequested 外部调用方是否要求不使用未经验证的缓存（刷新页面时浏览器会发送）
+func revalidateRequested(reqHeader http.Header, reqCC map[string]string) bool {
+	if _, noCache := reqCC["no-cache"]; noCache {
+		return true
+	}
+	if maxAge, ok := reqCC["max-age"]; ok && maxAge == "0" {
+		return true
+	}
+	return len(reqCC) == 0 && reqHeader.Get("Pragma") == "no-cache"
+}
+
+// notModified 外部请求的 If-None-Match（优先）或 If-Modified-Since 与响应的校验值匹配
+func notModified(reqHeader http.Header, resp *tunnel.Message) bool {
+	if resp.Type != tunnel.MessageTypeResponse || resp.Status != http.StatusOK {
+		return false
+	}
+	header := http.Header(resp.Headers)
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := reqHeader.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !lastModified.After(since)
+	}
+	return false
+}
+
+// cacheControl 解析 Cache-Control 指令，指令名小写，无参数的指令值为空
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
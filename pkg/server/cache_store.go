@@ -0,0 +1,303 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry 缓存的响应
+type CacheEntry struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Stored  time.Time // 最近一次从本地服务取得或重新验证的时间
+	Expires time.Time // 新鲜期截止，之后需经隧道重新验证
+
+	// Vary 响应 Vary 头列出的请求头及存储时请求中的值，值不同的请求不命中
+	Vary map[string]string
+}
+
+// size 估算条目占用的字节数
+func (e *CacheEntry) size() int64 {
+	n := int64(len(e.Body))
+	for k, values := range e.Header {
+		n += int64(len(k))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// CacheStore 响应缓存存储，按隧道隔离
+// 实现需要并发安全，并在超过容量时淘汰最久未使用的条目
+type CacheStore interface {
+	// Get 读取缓存，返回的条目不能被修改
+	Get(tunnelID, key string) (*CacheEntry, bool)
+	// Put 写入或替换缓存
+	Put(tunnelID, key string, entry *CacheEntry)
+	// Purge 清除隧道的全部缓存，tunnelID 为空时清除所有隧道，返回清除的条目数
+	Purge(tunnelID string) int
+}
+
+// lruIndex 按总大小淘汰的LRU索引
+type lruIndex struct {
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(item *lruItem)
+}
+
+// lruItem LRU索引中的一项
+type lruItem struct {
+	id       string // 索引键
+	tunnelID string
+	size     int64
+	entry    *CacheEntry // 内存缓存的条目，磁盘缓存为 nil
+}
+
+func newLRUIndex(maxSize int64, onEvict func(item *lruItem)) *lruIndex {
+	return &lruIndex{maxSize: maxSize, ll: list.New(), items: make(map[string]*list.Element), onEvict: onEvict}
+}
+
+// get 查找并标记为最近使用
+func (l *lruIndex) get(id string) (*lruItem, bool) {
+	el, ok := l.items[id]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add 添加或替换，超过容量时淘汰最久未使用的项
+func (l *lruIndex) add(item *lruItem) {
+	if el, ok := l.items[item.id]; ok {
+		l.size -= el.Value.(*lruItem).size
+		el.Value = item
+		l.ll.MoveToFront(el)
+	} else {
+		l.items[item.id] = l.ll.PushFront(item)
+	}
+	l.size += item.size
+	for l.size > l.maxSize && l.ll.Len() > 1 {
+		oldest := l.ll.Back()
+		l.remove(oldest.Value.(*lruItem).id)
+		l.onEvict(oldest.Value.(*lruItem))
+	}
+}
+
+// remove 删除一项
+func (l *lruIndex) remove(id string) {
+	if el, ok := l.items[id]; ok {
+		l.size -= el.Value.(*lruItem).size
+		l.ll.Remove(el)
+		delete(l.items, id)
+	}
+}
+
+// purge 删除隧道的全部项（tunnelID 为空时删除全部）
+func (l *lruIndex) purge(tunnelID string) []*lruItem {
+	var removed []*lruItem
+	for id, el := range l.items {
+		item := el.Value.(*lruItem)
+		if tunnelID == "" || item.tunnelID == tunnelID {
+			l.remove(id)
+			removed = append(removed, item)
+		}
+	}
+	return removed
+}
+
+// MemoryCache 内存缓存
+type MemoryCache struct {
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+// NewMemoryCache 创建内存缓存，maxSize 为总大小上限（字节）
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{index: newLRUIndex(maxSize, func(*lruItem) {})}
+}
+
+// Get 实现 CacheStore
+func (m *MemoryCache) Get(tunnelID, key string) (*CacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.index.get(tunnelID + "\x00" + key)
+	if !ok {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+// Put 实现 CacheStore
+func (m *MemoryCache) Put(tunnelID, key string, entry *CacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index.add(&lruItem{id: tunnelID + "\x00" + key, tunnelID: tunnelID, size: entry.size(), entry: entry})
+}
+
+// Purge 实现 CacheStore
+func (m *MemoryCache) Purge(tunnelID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.index.purge(tunnelID))
+}
+
+// diskTempPrefix 写入条目时临时文件的前缀，写完后重命名为正式文件
+const diskTempPrefix = ".tmp-"
+
+// DiskCache 磁盘缓存，每个隧道一个子目录，每个响应一个文件；重启后保留已有缓存
+type DiskCache struct {
+	dir   string
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+// NewDiskCache 创建磁盘缓存，maxSize 为总大小上限（字节）；目录中已有的缓存按修改时间载入
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{dir: dir}
+	d.index = newLRUIndex(maxSize, func(item *lruItem) {
+		os.Remove(filepath.Join(d.dir, item.id))
+	})
+
+	type existing struct {
+		item    *lruItem
+		modTime time.Time
+	}
+	var files []existing
+	tunnelDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, td := range tunnelDirs {
+		tunnelID, err := hex.DecodeString(td.Name())
+		if err != nil || !td.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, td.Name()))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			// 写入中途退出留下的临时文件不是有效条目
+			if strings.HasPrefix(e.Name(), diskTempPrefix) {
+				os.Remove(filepath.Join(dir, td.Name(), e.Name()))
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, existing{
+				item:    &lruItem{id: filepath.Join(td.Name(), e.Name()), tunnelID: string(tunnelID), size: info.Size()},
+				modTime: info.ModTime(),
+			})
+		}
+	}
+	// 按修改时间从旧到新加入，最近写入的最后淘汰
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		d.index.add(f.item)
+	}
+	return d, nil
+}
+
+// path 返回条目的相对路径
+func (d *DiskCache) path(tunnelID, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(hex.EncodeToString([]byte(tunnelID)), hex.EncodeToString(sum[:]))
+}
+
+// Get 实现 CacheStore
+func (d *DiskCache) Get(tunnelID, key string) (*CacheEntry, bool) {
+	id := d.path(tunnelID, key)
+	d.mu.Lock()
+	_, ok := d.index.get(id)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(d.dir, id))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	var stored struct {
+		Key   string
+		Entry CacheEntry
+	}
+	// 文件名是键的摘要，核对原始键
+	if err := gob.NewDecoder(f).Decode(&stored); err != nil || stored.Key != key {
+		return nil, false
+	}
+	return &stored.Entry, true
+}
+
+// Put 实现 CacheStore
+func (d *DiskCache) Put(tunnelID, key string, entry *CacheEntry) {
+	id := d.path(tunnelID, key)
+	if err := d.write(id, key, entry); err != nil {
+		return
+	}
+	info, err := os.Stat(filepath.Join(d.dir, id))
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.index.add(&lruItem{id: id, tunnelID: tunnelID, size: info.Size()})
+}
+
+// write 先写临时文件再重命名，读取方不会看到写了一半的文件
+func (d *DiskCache) write(id, key string, entry *CacheEntry) error {
+	path := filepath.Join(d.dir, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), diskTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	stored := struct {
+		Key   string
+		Entry CacheEntry
+	}{key, *entry}
+	if err := gob.NewEncoder(tmp).Encode(&stored); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("写入缓存失败: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Purge 实现 CacheStore
+func (d *DiskCache) Purge(tunnelID string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := d.index.purge(tunnelID)
+	for _, item := range removed {
+		os.Remove(filepath.Join(d.dir, item.id))
+	}
+	return len(removed)
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 集群内部转发
+const (
+	// clusterTokenHeader 节点间转发请求携带的共享密钥
+	clusterTokenHeader = "X-Tunnel-Cluster-Token"
+	// forwardedPrefixHeader 节点间转发请求携带的原始隧道路径前缀（用于改写响应中的链接）
+	forwardedPrefixHeader = "X-Forwarded-Prefix"
+	// clusterPathPrefix 接收其他节点转发请求的路由前缀
+	clusterPathPrefix = "/_cluster/tunnel"
+	// clusterForwardedKey 标记请求来自其他节点，不再继续转发
+	clusterForwardedKey = "tunnel.cluster.forwarded"
+
+	// DefaultClusterTTL 隧道登记的默认有效期
+	DefaultClusterTTL = 30 * time.Second
+)
+
+// ClusterOptions 集群选项：多个节点共享隧道登记，落到非隧道所在节点的HTTP请求转发给所在节点
+// 仅HTTP/SSE/WebSocket请求会跨节点转发，TCP、代理和访问者连接只使用本节点的隧道
+type ClusterOptions struct {
+	NodeID       string        // 节点ID，集群内唯一
+	AdvertiseURL string        // 其他节点访问本节点的地址，如 http://10.0.0.2:8080
+	Token        string        // 节点间转发请求的共享密钥
+	Store        ClusterStore  // 共享的隧道登记存储（必填）
+	TTL          time.Duration // 登记有效期，0表示默认30秒；节点按 TTL/3 续期，超过有效期未续期的登记视为失效
+}
+
+// cluster 集群状态
+// 登记是否过期不比较登记节点写入的时间（节点间时钟可能不一致），而是由各节点按自己的时钟
+// 记录每个登记的 Lease 最后一次变化的时间，超过 TTL 未变化即视为失效
+type cluster struct {
+	opts  ClusterOptions
+	stop  chan struct{}
+	lease atomic.Uint64 // 本节点的续期序号
+
+	mu     sync.Mutex
+	leases map[string]observedLease // 隧道ID -> 观察到的其他节点登记
+}
+
+// observedLease 本节点观察到的登记续期
+type observedLease struct {
+	nodeID string
+	lease  uint64
+	seenAt time.Time // 本节点观察到该续期序号的本地时间
+}
+
+// newCluster 创建集群状态，未设置 NodeID 时随机生成
+func newCluster(opts ClusterOptions) *cluster {
+	if opts.NodeID == "" {
+		opts.NodeID = "node-" + generateTunnelID()[len("tunnel-"):]
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultClusterTTL
+	}
+	cl := &cluster{opts: opts, stop: make(chan struct{}), leases: make(map[string]observedLease)}
+	// 序号从当前时间开始，节点以相同 NodeID 重启后的续期不会与重启前的序号重复
+	cl.lease.Store(uint64(time.Now().UnixNano()))
+	return cl
+}
+
+// startCluster 定期续期本节点隧道的登记
+func (s *Server) startCluster() {
+	ticker := time.NewTicker(s.cluster.opts.TTL / 3)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, id := range s.manager.TunnelIDs() {
+					s.claimTunnel(id)
+				}
+			case <-s.cluster.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCluster 停止续期并删除 ids 的登记（隧道已断开后调用）
+func (s *Server) stopCluster(ids []string) {
+	close(s.cluster.stop)
+	for _, id := range ids {
+		s.releaseTunnel(id)
+	}
+}
+
+// claimTunnel 登记隧道在本节点
+func (s *Server) claimTunnel(tunnelID string) {
+	if s.cluster == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reg := Registration{
+		TunnelID:  tunnelID,
+		NodeID:    s.cluster.opts.NodeID,
+		NodeAddr:  s.cluster.opts.AdvertiseURL,
+		UpdatedAt: time.Now(),
+		Lease:     s.cluster.lease.Add(1),
+	}
+	// 本地上游健康状态随续期同步给其他节点
+	if t, exists := s.manager.GetTunnel(tunnelID); exists {
+		for _, h := range t.Health() {
+			if !h.Healthy {
+				reg.Unhealthy = append(reg.Unhealthy, h.Name)
+			}
+		}
+	}
+	err := s.cluster.opts.Store.Put(ctx, reg)
+	if err != nil {
+		log.Printf("登记隧道 %s 失败: %v", tunnelID, err)
+	}
+}
+
+// releaseTunnel 删除本节点的隧道登记，同ID的新连接仍在本节点时保留
+func (s *Server) releaseTunnel(tunnelID string) {
+	if s.cluster == nil {
+		return
+	}
+	if _, exists := s.manager.GetTunnel(tunnelID); exists {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.cluster.opts.Store.Delete(ctx, tunnelID, s.cluster.opts.NodeID); err != nil {
+		log.Printf("删除隧道登记 %s 失败: %v", tunnelID, err)
+	}
+}
+
+// tunnelIDs 返回可用于选择的隧道ID（按ID排序），集群模式下包含其他节点的有效登记，
+// 跳过其他节点登记为 upstream 不健康的隧道（本节点的隧道由 healthyTunnels 过滤）
+func (s *Server) tunnelIDs(ctx context.Context, upstream string) []string {
+	ids := s.manager.TunnelIDs()
+	if s.cluster == nil {
+		return ids
+	}
+	regs, err := s.cluster.opts.Store.List(ctx)
+	if err != nil {
+		log.Printf("读取集群隧道登记失败: %v", err)
+		return ids
+	}
+	s.cluster.forget(regs)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, reg := range regs {
+		if !seen[reg.TunnelID] && s.cluster.live(reg) && !slices.Contains(reg.Unhealthy, upstream) {
+			seen[reg.TunnelID] = true
+			ids = append(ids, reg.TunnelID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// live 登记是否属于其他节点且仍在有效期内
+// 首次观察到的登记从观察时刻起计算有效期：已失效节点遗留的登记最多再被使用一个 TTL
+func (cl *cluster) live(reg Registration) bool {
+	if reg.NodeID == cl.opts.NodeID {
+		return false
+	}
+	now := time.Now()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	observed, ok := cl.leases[reg.TunnelID]
+	if !ok || observed.nodeID != reg.NodeID || observed.lease != reg.Lease {
+		cl.leases[reg.TunnelID] = observedLease{nodeID: reg.NodeID, lease: reg.Lease, seenAt: now}
+		return true
+	}
+	return now.Sub(observed.seenAt) < cl.opts.TTL
+}
+
+// forget 清除存储中已不存在的登记的观察记录
+func (cl *cluster) forget(regs []Registration) {
+	exists := make(map[string]bool, len(regs))
+	for _, reg := range regs {
+		exists[reg.TunnelID] = true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for id := range cl.leases {
+		if !exists[id] {
+			delete(cl.leases, id)
+		}
+	}
+}
+
+// forwardToOwner 将请求转发给隧道所在的节点，隧道未登记在其他节点时返回 false
+func (s *Server) forwardToOwner(c *gin.Context, tunnelID, path string) bool {
+	if s.cluster == nil || c.GetBool(clusterForwardedKey) {
+		return false
+	}
+	reg, ok, err := s.cluster.opts.Store.Get(c.Request.Context(), tunnelID)
+	if err != nil {
+		log.Printf("查询隧道登记 %s 失败: %v", tunnelID, err)
+		return false
+	}
+	if !ok || !s.cluster.live(reg) {
+		return false
+	}
+	target, err := url.Parse(reg.NodeAddr)
+	if err != nil || target.Host == "" {
+		log.Printf("节点 %s 的地址无效: %q", reg.NodeID, reg.NodeAddr)
+		return false
+	}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.URL.Path = target.Path + clusterPathPrefix + "/" + url.PathEscape(tunnelID) + path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Header.Set(clusterTokenHeader, s.cluster.opts.Token)
+			pr.Out.Header.Set(forwardedPrefixHeader, strings.TrimSuffix(c.Request.URL.Path, path))
+			pr.SetXForwarded()
+		},
+		// SSE 等流式响应立即刷新
+		FlushInterval: -1,
+		Transport:     clusterTransport(c.Request),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("转发请求到节点 %s 失败: %v", reg.NodeID, err)
+			s.writeError(c, tunnel.ErrUpstreamUnreachable, "转发请求到隧道所在节点失败")
+		},
+	}
+	rp.ServeHTTP(c.Writer, c.Request)
+	return true
+}
+
+// clusterH2Transport 节点间转发 HTTP/2 请求（gRPC 等）使用的连接池，http:// 节点使用 h2c
+var clusterH2Transport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}()
+
+// clusterTransport 外部请求为 HTTP/2 时节点间同样使用 HTTP/2，保留 trailers 和双向流
+func clusterTransport(r *http.Request) http.RoundTripper {
+	if r.ProtoMajor == 2 {
+		return clusterH2Transport
+	}
+	return http.DefaultTransport
+}
+
+// handleClusterRequest 处理其他节点转发来的请求，只使用本节点的隧道
+func (s *Server) handleClusterRequest(c *gin.Context) {
+	token := c.GetHeader(clusterTokenHeader)
+	if s.cluster.opts.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.cluster.opts.Token)) != 1 {
+		log.Printf("拒绝未认证的集群转发请求，来自 %s", c.ClientIP())
+		s.writeError(c, tunnel.ErrForbidden, "集群密钥错误")
+		return
+	}
+	c.Request.Header.Del(clusterTokenHeader)
+	c.Set(clusterForwardedKey, true)
+	s.processProxyRequest(c, c.Param("tunnelID"), c.Param("path"))
+}
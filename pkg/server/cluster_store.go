@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration 隧道所在节点的登记信息
+type Registration struct {
+	TunnelID  string    `json:"tunnel_id"`
+	NodeID    string    `json:"node_id"`
+	NodeAddr  string    `json:"node_addr"`  // 节点的内部访问地址（ClusterOptions.AdvertiseURL）
+	UpdatedAt time.Time `json:"updated_at"` // 登记节点的本地时间，仅供查看，有效期按 Lease 判断
+	// Lease 续期序号，登记节点每次续期递增；其他节点按自己的时钟记录序号最后一次变化的时间判断是否过期
+	Lease uint64 `json:"lease"`
+	// Unhealthy 客户端上报不健康的本地上游（tunnel.UpstreamHTTP 等），其他节点选择隧道时跳过
+	Unhealthy []string `json:"unhealthy,omitempty"`
+}
+
+// ClusterStore 集群共享的隧道登记存储，多个节点读写同一份数据
+// 实现需要并发安全；过期登记由调用方按 Lease 的变化判断，存储本身无需清理
+type ClusterStore interface {
+	// Put 登记或续期隧道，覆盖其他节点的旧登记
+	Put(ctx context.Context, reg Registration) error
+	// Delete 删除隧道登记，仅当登记仍属于 nodeID 时删除
+	Delete(ctx context.Context, tunnelID, nodeID string) error
+	// Get 查询隧道登记
+	Get(ctx context.Context, tunnelID string) (Registration, bool, error)
+	// List 返回全部登记
+	List(ctx context.Context) ([]Registration, error)
+}
+
+// MemoryStore 进程内存储，用于在同一进程内运行多个节点（测试或嵌入场景）
+type MemoryStore struct {
+	mu   sync.Mutex
+	regs map[string]Registration
+}
+
+// NewMemoryStore 创建进程内存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{regs: make(map[string]Registration)}
+}
+
+// Put 实现 ClusterStore
+func (m *MemoryStore) Put(ctx context.Context, reg Registration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.regs[reg.TunnelID] = reg
+	return nil
+}
+
+// Delete 实现 ClusterStore
+func (m *MemoryStore) Delete(ctx context.Context, tunnelID, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reg, ok := m.regs[tunnelID]; ok && reg.NodeID == nodeID {
+		delete(m.regs, tunnelID)
+	}
+	return nil
+}
+
+// Get 实现 ClusterStore
+func (m *MemoryStore) Get(ctx context.Context, tunnelID string) (Registration, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reg, ok := m.regs[tunnelID]
+	return reg, ok, nil
+}
+
+// List 实现 ClusterStore
+func (m *MemoryStore) List(ctx context.Context) ([]Registration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	regs := make([]Registration, 0, len(m.regs))
+	for _, reg := range m.regs {
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+// DirStore 基于共享目录的存储（如 NFS），每个隧道一个 JSON 文件，写入时先写临时文件再重命名
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore 创建目录存储，目录不存在时自动创建
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// file 返回隧道登记文件路径，隧道ID按十六进制编码避免路径字符
+func (d *DirStore) file(tunnelID string) string {
+	return filepath.Join(d.dir, hex.EncodeToString([]byte(tunnelID))+".json")
+}
+
+// Put 实现 ClusterStore
+func (d *DirStore) Put(ctx context.Context, reg Registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.file(reg.TunnelID))
+}
+
+// Delete 实现 ClusterStore
+func (d *DirStore) Delete(ctx context.Context, tunnelID, nodeID string) error {
+	reg, ok, err := d.Get(ctx, tunnelID)
+	if err != nil || !ok || reg.NodeID != nodeID {
+		return err
+	}
+	if err := os.Remove(d.file(tunnelID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Get 实现 ClusterStore
+func (d *DirStore) Get(ctx context.Context, tunnelID string) (Registration, bool, error) {
+	return d.read(d.file(tunnelID))
+}
+
+// List 实现 ClusterStore
+func (d *DirStore) List(ctx context.Context) ([]Registration, error) {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var regs []Registration
+	for _, f := range files {
+		reg, ok, err := d.read(f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			regs = append(regs, reg)
+		}
+	}
+	return regs, nil
+}
+
+// read 读取登记文件，文件不存在时返回 false
+func (d *DirStore) read(path string) (Registration, bool, error) {
+	var reg Registration
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reg, false, nil
+	}
+	if err != nil {
+		return reg, false, err
+	}
+	if err := json.Unmarshal(data, &reg); err != nil {
+		return reg, false, fmt.Errorf("解析登记文件 %s 失败: %v", path, err)
+	}
+	return reg, true, nil
+}
+
+// SQLStore 基于 database/sql 的存储，使用 tunnel_registry 表
+// 数据库驱动由调用方导入并打开 *sql.DB，driver 为 postgres/pgx 时使用 $n 占位符，其余使用 ?
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// NewSQLStore 创建SQL存储，表不存在时自动创建
+func NewSQLStore(ctx context.Context, db *sql.DB, driver string) (*SQLStore, error) {
+	s := &SQLStore{db: db, postgres: driver == "postgres" || driver == "pgx"}
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS tunnel_registry (
+	tunnel_id VARCHAR(255) PRIMARY KEY,
+	node_id VARCHAR(255) NOT NULL,
+	node_addr VARCHAR(1024) NOT NULL,
+	updated_at BIGINT NOT NULL,
+	unhealthy VARCHAR(1024) NOT NULL DEFAULT '',
+	lease BIGINT NOT NULL DEFAULT 0
+)`)
+	if err != nil {
+		return nil, fmt.Errorf("创建 tunnel_registry 表失败: %v", err)
+	}
+	// 旧版本创建的表缺少后来增加的列
+	for _, column := range []string{
+		"unhealthy VARCHAR(1024) NOT NULL DEFAULT ''",
+		"lease BIGINT NOT NULL DEFAULT 0",
+	} {
+		_, err := db.ExecContext(ctx, "ALTER TABLE tunnel_registry ADD COLUMN "+column)
+		if err != nil && !isDuplicateColumn(err) {
+			return nil, fmt.Errorf("升级 tunnel_registry 表失败: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// isDuplicateColumn 是否为列已存在的错误
+// mysql 返回 Duplicate column name，postgres 返回 column ... already exists
+func isDuplicateColumn(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate column") || strings.Contains(msg, "already exists")
+}
+
+// query 按驱动替换占位符
+func (s *SQLStore) query(q string) string {
+	if !s.postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Put 实现 ClusterStore，各数据库的 upsert 语法不同，这里在事务中先删除再插入
+func (s *SQLStore) Put(ctx context.Context, reg Registration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM tunnel_registry WHERE tunnel_id = ?"), reg.TunnelID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.query("INSERT INTO tunnel_registry (tunnel_id, node_id, node_addr, updated_at, unhealthy, lease) VALUES (?, ?, ?, ?, ?, ?)"),
+		reg.TunnelID, reg.NodeID, reg.NodeAddr, reg.UpdatedAt.UnixMilli(), strings.Join(reg.Unhealthy, ","), int64(reg.Lease)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete 实现 ClusterStore
+func (s *SQLStore) Delete(ctx context.Context, tunnelID, nodeID string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM tunnel_registry WHERE tunnel_id = ? AND node_id = ?"), tunnelID, nodeID)
+	return err
+}
+
+// Get 实现 ClusterStore
+func (s *SQLStore) Get(ctx context.Context, tunnelID string) (Registration, bool, error) {
+	reg := Registration{TunnelID: tunnelID}
+	var updated, lease int64
+	var unhealthy string
+	err := s.db.QueryRowContext(ctx, s.query("SELECT node_id, node_addr, updated_at, unhealthy, lease FROM tunnel_registry WHERE tunnel_id = ?"), tunnelID).
+		Scan(&reg.NodeID, &reg.NodeAddr, &updated, &unhealthy, &lease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return reg, false, nil
+	}
+	if err != nil {
+		return reg, false, err
+	}
+	reg.UpdatedAt = time.UnixMilli(updated)
+	reg.Unhealthy = splitList(unhealthy)
+	reg.Lease = uint64(lease)
+	return reg, true, nil
+}
+
+// List 实现 ClusterStore
+func (s *SQLStore) List(ctx context.Context) ([]Registration, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT tunnel_id, node_id, node_addr, updated_at, unhealthy, lease FROM tunnel_registry")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var regs []Registration
+	for rows.Next() {
+		var reg Registration
+		var updated, lease int64
+		var unhealthy string
+		if err := rows.Scan(&reg.TunnelID, &reg.NodeID, &reg.NodeAddr, &updated, &unhealthy, &lease); err != nil {
+			return nil, err
+		}
+		reg.UpdatedAt = time.UnixMilli(updated)
+		reg.Unhealthy = splitList(unhealthy)
+		reg.Lease = uint64(lease)
+		regs = append(regs, reg)
+	}
+	return regs, rows.Err()
+}
+
+// splitList 拆分逗号分隔的列表，空字符串返回 nil
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,16 @@
+package server
+
+// healthyTunnels 过滤掉上报指定本地上游不健康的隧道，用于未指定隧道时的选择
+// 其他节点的隧道和未开启健康检查的隧道视为健康
+func (s *Server) healthyTunnels(ids []string, upstream string) []string {
+	healthy := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if t, exists := s.manager.GetTunnel(id); exists {
+			if ok, _ := t.UpstreamHealthy(upstream); !ok {
+				continue
+			}
+		}
+		healthy = append(healthy, id)
+	}
+	return healthy
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// 隧道选择失败时返回的错误
+var (
+	// ErrNoTunnel 没有可用的隧道（返回503）
+	ErrNoTunnel = errors.New("没有可用的隧道连接")
+	// ErrAmbiguousTunnel 无法确定使用哪个隧道（返回400）
+	ErrAmbiguousTunnel = errors.New("请使用 /tunnel/{隧道ID}/ 前缀访问或仅保持一个隧道连接")
+)
+
+// Authenticator 校验客户端的隧道注册
+type Authenticator interface {
+	// Authenticate 在客户端发送注册消息后调用，r 为客户端的WebSocket握手请求，
+	// tunnelID 为客户端申请的隧道ID（可能为空）；返回错误时拒绝注册并把错误信息回传给客户端
+	Authenticate(r *http.Request, tunnelID string) error
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(r *http.Request, tunnelID string) error
+
+// Authenticate 实现 Authenticator
+func (f AuthenticatorFunc) Authenticate(r *http.Request, tunnelID string) error {
+	return f(r, tunnelID)
+}
+
+// TunnelSelector 为未指定隧道的请求（无 /tunnel/{隧道ID}/ 前缀的HTTP请求、TCP连接）选择隧道
+type TunnelSelector interface {
+	// SelectTunnel 从当前已连接的隧道（按ID排序）中选择一个；
+	// r 为外部HTTP请求，TCP连接时为 nil
+	SelectTunnel(r *http.Request, tunnels []string) (string, error)
+}
+
+// TunnelSelectorFunc 函数形式的 TunnelSelector
+type TunnelSelectorFunc func(r *http.Request, tunnels []string) (string, error)
+
+// SelectTunnel 实现 TunnelSelector
+func (f TunnelSelectorFunc) SelectTunnel(r *http.Request, tunnels []string) (string, error) {
+	return f(r, tunnels)
+}
+
+// FirstTunnel 使用第一个可用隧道（私人使用模式）
+var FirstTunnel TunnelSelector = TunnelSelectorFunc(func(r *http.Request, tunnels []string) (string, error) {
+	if len(tunnels) == 0 {
+		return "", ErrNoTunnel
+	}
+	return tunnels[0], nil
+})
+
+// SingleTunnel 仅当存在唯一隧道时才允许省略前缀（多隧道模式）
+// 没有隧道时返回 ErrNoTunnel，按隧道离线处理
+var SingleTunnel TunnelSelector = TunnelSelectorFunc(func(r *http.Request, tunnels []string) (string, error) {
+	if len(tunnels) == 0 {
+		return "", ErrNoTunnel
+	}
+	if len(tunnels) > 1 {
+		return "", ErrAmbiguousTunnel
+	}
+	return tunnels[0], nil
+})
+
+// EventSink 接收服务端事件，用于审计、统计等；方法在处理协程中同步调用，不应阻塞
+type EventSink interface {
+	// TunnelConnected 隧道注册成功
+	TunnelConnected(tunnelID string, r *http.Request)
+	// TunnelDisconnected 隧道连接断开
+	TunnelDisconnected(tunnelID string)
+	// RequestServed 一个外部请求或TCP连接处理完成
+	RequestServed(info RequestInfo)
+}
+
+// RequestInfo 已处理的外部请求信息
+type RequestInfo struct {
+	TunnelID string
+	ID       string
+	Kind     string // http / sse / websocket / tcp
+	Method   string
+	Path     string
+	Status   int // 返回给外部调用方的状态码（TCP为0）
+	Duration time.Duration
+}
+
+// nopSink 默认的空事件接收器
+type nopSink struct{}
+
+func (nopSink) TunnelConnected(string, *http.Request) {}
+func (nopSink) TunnelDisconnected(string)             {}
+func (nopSink) RequestServed(RequestInfo)             {}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Offline 隧道离线（客户端未连接）时的处理
+type Offline struct {
+	// Wait 幂等请求等待客户端重连的最长时间，重连后继续转发（请求发出后隧道断开的普通HTTP请求会重放一次）；0表示不等待
+	Wait time.Duration
+	// Page 维护页内容，离线时以503返回，nil表示返回 tunnel_not_found 错误响应
+	Page []byte
+	// PageType 维护页的 Content-Type
+	PageType string
+}
+
+// OfflineFromConfig 将配置转换为离线处理，读取维护页文件
+func OfflineFromConfig(cfg common.OfflineConfig) (Offline, error) {
+	offline := Offline{Wait: time.Duration(cfg.Wait) * time.Second}
+	if cfg.Page == "" {
+		return offline, nil
+	}
+	page, err := os.ReadFile(cfg.Page)
+	if err != nil {
+		return Offline{}, err
+	}
+	offline.Page = page
+	offline.PageType = mime.TypeByExtension(filepath.Ext(cfg.Page))
+	if offline.PageType == "" {
+		offline.PageType = http.DetectContentType(page)
+	}
+	return offline, nil
+}
+
+// TunnelOfflineFromConfig 按隧道合并全局与隧道级的离线处理配置
+func TunnelOfflineFromConfig(cfg common.TunnelServerConfig) (map[string]Offline, error) {
+	tunnels := make(map[string]Offline, len(cfg.Tunnels))
+	for id, opts := range cfg.Tunnels {
+		offline, err := OfflineFromConfig(cfg.Offline.Merge(opts.Offline))
+		if err != nil {
+			return nil, err
+		}
+		tunnels[id] = offline
+	}
+	return tunnels, nil
+}
+
+// offline 返回指定隧道生效的离线处理，tunnelID 为空（未能选出隧道）时使用全局设置
+func (s *Server) offline(tunnelID string) Offline {
+	if o, ok := s.opts.TunnelOffline[tunnelID]; ok {
+		return o
+	}
+	return s.opts.Offline
+}
+
+// isIdempotent 请求方法是否幂等，只有幂等请求可以等待重连或重放
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// waitTunnel 隧道离线时，幂等请求等待客户端重连（最长 Offline.Wait）
+func (s *Server) waitTunnel(c *gin.Context, tunnelID string) (*tunnel.Tunnel, bool) {
+	wait := s.offline(tunnelID).Wait
+	if wait <= 0 || !isIdempotent(c.Request.Method) {
+		return nil, false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		registered := s.manager.Registered()
+		// 断开的隧道在注销前仍可能被查到
+		if t, exists := s.manager.GetTunnel(tunnelID); exists && !isClosed(t) {
+			return t, true
+		}
+		select {
+		case <-registered:
+		case <-timer.C:
+			return nil, false
+		case <-c.Request.Context().Done():
+			return nil, false
+		}
+	}
+}
+
+// selectTunnel 为无隧道前缀的请求选择隧道，没有可用隧道时幂等请求等待客户端连接（最长全局的 Offline.Wait）
+func (s *Server) selectTunnel(c *gin.Context) (string, error) {
+	var timer *time.Timer
+	for {
+		registered := s.manager.Registered()
+		tunnelIDs := s.healthyTunnels(s.tunnelIDs(c.Request.Context(), tunnel.UpstreamHTTP), tunnel.UpstreamHTTP)
+		tunnelID, err := s.opts.Selector.SelectTunnel(c.Request, tunnelIDs)
+		if err == nil || errors.Is(err, ErrAmbiguousTunnel) || s.opts.Offline.Wait <= 0 || !isIdempotent(c.Request.Method) {
+			return tunnelID, err
+		}
+		if timer == nil {
+			timer = time.NewTimer(s.opts.Offline.Wait)
+			defer timer.Stop()
+		}
+		select {
+		case <-registered:
+		case <-timer.C:
+			return "", err
+		case <-c.Request.Context().Done():
+			return "", err
+		}
+	}
+}
+
+// writeOffline 隧道离线或本地服务不健康时返回维护页，未配置时按 code 返回错误响应
+func (s *Server) writeOffline(c *gin.Context, tunnelID string, code tunnel.ErrorCode, message string) {
+	offline := s.offline(tunnelID)
+	// gRPC 调用方无法展示维护页
+	if offline.Page == nil || proxy.IsGRPCRequest(c.Request.Header) {
+		s.writeError(c, code, message)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusServiceUnavailable, offline.PageType, offline.Page)
+}
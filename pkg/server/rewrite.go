@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strings"
+
+	"awesomeProject/internal/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rewrite 返回指定隧道生效的改写规则，nil表示不改写
+func (s *Server) rewrite(tunnelID string) *Rewrite {
+	if r, ok := s.opts.TunnelRewrite[tunnelID]; ok {
+		return r
+	}
+	return s.opts.Rewrite
+}
+
+// publicOrigin 返回外部调用方看到的地址，path 为去掉隧道前缀后的路径
+// 其他节点转发的请求使用原始请求的 X-Forwarded-Host 和 X-Forwarded-Prefix
+func publicOrigin(c *gin.Context, path string) proxy.PublicOrigin {
+	origin := proxy.PublicOrigin{
+		Scheme: "http",
+		Host:   c.Request.Host,
+		Prefix: strings.TrimSuffix(c.Request.URL.Path, path),
+	}
+	if c.Request.TLS != nil {
+		origin.Scheme = "https"
+	}
+	// 前面有 TLS 终结的反向代理时以其声明的协议为准
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		origin.Scheme = proto
+	}
+	if c.GetBool(clusterForwardedKey) {
+		if host := c.GetHeader("X-Forwarded-Host"); host != "" {
+			origin.Host = host
+		}
+		origin.Prefix = c.GetHeader(forwardedPrefixHeader)
+	}
+	return origin
+}
@@ -0,0 +1,536 @@
+// Package server 内网穿透服务端，可嵌入到已有的 http.Server 或 gin 路由中使用
+//
+// 挂载到已有的 gin 路由：
+//
+//	s := server.New(server.Options{PrivateUse: true})
+//	defer s.Close()
+//	s.Mount(router)
+//
+// 或直接作为 http.Handler：
+//
+//	http.ListenAndServe(":8080", s.Handler())
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Timeouts 代理超时设置，零值字段使用默认值（Idle 为0表示不限制）
+type Timeouts = proxy.Timeouts
+
+// Compression 隧道消息压缩设置（WebSocket permessage-deflate，客户端也开启时生效）
+type Compression = tunnel.Compression
+
+// Rewrite 请求/响应改写规则
+type Rewrite = proxy.Rewrite
+
+// UpstreamHealth 客户端本地上游的健康状态
+type UpstreamHealth = tunnel.UpstreamHealth
+
+// ErrorPages 对外部调用方返回的错误响应（按 Accept 返回HTML错误页或JSON），由 LoadErrorPages 创建
+type ErrorPages = proxy.ErrorPages
+
+// LoadErrorPages 加载HTML错误页模板，path 为空时使用内置模板
+func LoadErrorPages(path string) (*ErrorPages, error) {
+	return proxy.LoadErrorPages(path)
+}
+
+// Options 服务端选项
+type Options struct {
+	// PrivateUse 私人使用模式：不注册 /tunnel/{隧道ID}/ 前缀路由，默认选择第一个可用隧道
+	PrivateUse bool
+
+	Timeouts         Timeouts            // 全局代理超时
+	TunnelTimeouts   map[string]Timeouts // 按隧道覆盖的代理超时
+	WSMaxMessageSize int64               // 外部WebSocket单条消息大小上限，0表示不限制
+	Compression      *Compression        // 隧道消息压缩，nil表示不压缩
+	ErrorPages       *ErrorPages         // 错误响应，nil表示使用内置模板
+	Offline          Offline             // 隧道离线时的处理
+	TunnelOffline    map[string]Offline  // 按隧道覆盖的离线处理（整体替换 Offline）
+	Rewrite          *Rewrite            // 请求/响应改写规则，nil表示不改写
+	TunnelRewrite    map[string]*Rewrite // 按隧道覆盖的改写规则（整体替换 Rewrite）
+	Cache            *CacheOptions       // 响应缓存，nil表示不缓存
+	Admin            *AdminOptions       // 管理接口，nil表示不开启
+
+	// MinProtocolVersion 允许注册的最低客户端协议版本，0表示兼容所有版本（含未携带版本号的旧客户端）
+	MinProtocolVersion int
+
+	// ProxyAuth 校验 SOCKS5/HTTP CONNECT 代理的用户名密码，nil表示不校验（见 ServeProxy）
+	ProxyAuth func(username, password string) bool
+	// ProxyTunnel 代理的出口隧道，为空时由 Selector 选择
+	ProxyTunnel string
+
+	Authenticator Authenticator  // 隧道注册校验，nil表示不校验
+	Selector      TunnelSelector // 未指定隧道时的选择策略，nil时按 PrivateUse 使用 FirstTunnel 或 SingleTunnel
+	Events        EventSink      // 事件接收器，nil表示忽略
+
+	// Cluster 集群选项，nil表示单节点运行
+	Cluster *ClusterOptions
+}
+
+// Server 内网穿透服务端
+type Server struct {
+	opts     Options
+	manager  *tunnel.Manager
+	proxy    *proxy.HTTPProxy
+	services serviceRegistry // 私有TCP服务（访问者模式）
+	cluster  *cluster        // 集群模式下的隧道登记，nil表示单节点
+
+	cacheMu      sync.RWMutex
+	cacheTunnels map[string]bool // 运行时（管理接口）设置的按隧道缓存开关，优先于 CacheOptions
+}
+
+// New 创建服务端并启动隧道心跳检测
+func New(opts Options) *Server {
+	if opts.Selector == nil {
+		if opts.PrivateUse {
+			opts.Selector = FirstTunnel
+		} else {
+			opts.Selector = SingleTunnel
+		}
+	}
+	if opts.Events == nil {
+		opts.Events = nopSink{}
+	}
+
+	tunnels := make(map[string]Timeouts, len(opts.TunnelTimeouts))
+	for id, t := range opts.TunnelTimeouts {
+		tunnels[id] = withDefaults(t)
+	}
+
+	manager := tunnel.NewManager()
+	manager.StartHeartbeat()
+
+	s := &Server{
+		opts:     opts,
+		manager:  manager,
+		proxy:    proxy.NewHTTPProxy(manager, withDefaults(opts.Timeouts), tunnels),
+		services: serviceRegistry{services: make(map[string]*privateService)},
+
+		cacheTunnels: make(map[string]bool),
+	}
+	if opts.Cluster != nil {
+		s.cluster = newCluster(*opts.Cluster)
+		s.startCluster()
+	}
+	return s
+}
+
+// Close 停止心跳检测并断开所有隧道，集群模式下同时删除本节点的隧道登记
+func (s *Server) Close() error {
+	ids := s.manager.TunnelIDs()
+	s.manager.Close()
+	if s.cluster != nil {
+		s.stopCluster(ids)
+	}
+	return nil
+}
+
+// Tunnels 返回当前已连接的隧道ID（按ID排序）
+func (s *Server) Tunnels() []string {
+	return s.manager.TunnelIDs()
+}
+
+// TunnelInfo 已连接隧道的握手信息
+type TunnelInfo struct {
+	ID              string             `json:"id"`
+	ProtocolVersion int                `json:"protocol_version"` // 客户端协议版本
+	Capabilities    []string           `json:"capabilities"`     // 双方都支持的能力
+	Client          *tunnel.ClientInfo `json:"client,omitempty"` // 客户端软件及运行环境，旧版本客户端为 nil
+	Health          []UpstreamHealth   `json:"health,omitempty"` // 客户端上报的本地上游健康状态，未开启健康检查时为 nil
+	RemoteAddr      string             `json:"remote_addr"`
+}
+
+// TunnelInfo 返回已连接隧道的握手信息
+func (s *Server) TunnelInfo(tunnelID string) (TunnelInfo, bool) {
+	t, exists := s.manager.GetTunnel(tunnelID)
+	if !exists {
+		return TunnelInfo{}, false
+	}
+	return TunnelInfo{
+		ID:              t.ID,
+		ProtocolVersion: t.PeerVersion(),
+		Capabilities:    t.Capabilities(),
+		Client:          t.Client(),
+		Health:          t.Health(),
+		RemoteAddr:      t.Conn.RemoteAddr().String(),
+	}, true
+}
+
+// Handler 返回包含全部路由的 http.Handler（/ws、/health 以及代理路由）
+func (s *Server) Handler() http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	s.Mount(router)
+	return router
+}
+
+// Mount 将隧道路由注册到已有的 gin 路由器
+// 无前缀的代理请求通过 NoRoute 处理，因此需要传入 *gin.Engine
+func (s *Server) Mount(router *gin.Engine) {
+	// WebSocket连接端点（客户端连接）- 必须在通配符路由之前
+	router.GET("/ws", s.TunnelHandler())
+
+	// 健康检查 - 必须在通配符路由之前
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	// 管理接口
+	if s.opts.Admin != nil && s.opts.Admin.Token != "" {
+		s.mountAdmin(router)
+	}
+
+	// 集群内其他节点转发的请求
+	if s.cluster != nil {
+		router.Any(clusterPathPrefix+"/:tunnelID/*path", s.handleClusterRequest)
+	}
+
+	// 根据配置决定是否启用多隧道路由
+	if !s.opts.PrivateUse {
+		// HTTP代理端点（外部请求）- 多隧道场景
+		router.Any("/tunnel/:tunnelID/*path", s.handleProxyRequest)
+		log.Println("多隧道模式已启用，支持 /tunnel/{隧道ID}/ 前缀访问")
+	} else {
+		log.Println("私人使用模式已启用，仅支持直接路径访问（无需 /tunnel/ 前缀）")
+	}
+
+	// 单隧道场景下的简化访问（使用 NoRoute 处理未匹配的路由）
+	router.NoRoute(s.ProxyHandler())
+}
+
+// TunnelHandler 返回处理客户端隧道连接的处理器
+func (s *Server) TunnelHandler() gin.HandlerFunc {
+	return s.handleWebSocket
+}
+
+// ProxyHandler 返回代理处理器，由 TunnelSelector 选择隧道，请求路径原样转发
+func (s *Server) ProxyHandler() gin.HandlerFunc {
+	return s.handleDefaultProxyRequest
+}
+
+// Proxy 将当前请求经指定隧道转发，path 为转发到客户端本地服务的路径
+func (s *Server) Proxy(c *gin.Context, tunnelID, path string) {
+	s.processProxyRequest(c, tunnelID, path)
+}
+
+// handleWebSocket 处理WebSocket连接（客户端连接）
+func (s *Server) handleWebSocket(c *gin.Context) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		EnableCompression: s.opts.Compression != nil,
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket升级失败: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	log.Println("新的WebSocket连接")
+
+	// 等待客户端注册消息
+	var tunnelID string
+	for {
+		var msg tunnel.Message
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			log.Printf("读取消息失败: %v", err)
+			return
+		}
+
+		if msg.Type == tunnel.MessageTypeRegister {
+			// 协议版本过低的客户端直接拒绝，并提示升级
+			version := tunnel.PeerVersion(&msg)
+			minVersion := max(s.opts.MinProtocolVersion, tunnel.MinProtocolVersion)
+			if version < minVersion {
+				log.Printf("拒绝协议版本 %d 的客户端 %s（最低要求 %d）", version, msg.TunnelID, minVersion)
+				conn.WriteJSON(tunnel.Message{
+					Type:     tunnel.MessageTypeError,
+					TunnelID: msg.TunnelID,
+					Version:  tunnel.ProtocolVersion,
+					Error:    fmt.Sprintf("客户端协议版本 %d 过低，服务端要求至少 %d，请升级客户端", version, minVersion),
+				})
+				return
+			}
+
+			// 校验注册请求
+			if s.opts.Authenticator != nil {
+				if err := s.opts.Authenticator.Authenticate(c.Request, msg.TunnelID); err != nil {
+					log.Printf("隧道注册被拒绝 %s: %v", msg.TunnelID, err)
+					conn.WriteJSON(tunnel.Message{
+						Type:     tunnel.MessageTypeError,
+						TunnelID: msg.TunnelID,
+						Code:     tunnel.ErrAuthFailed,
+						Error:    "认证失败: " + err.Error(),
+					})
+					return
+				}
+			}
+
+			tunnelID = msg.TunnelID
+			if tunnelID == "" {
+				// 如果没有提供tunnelID，生成一个
+				tunnelID = generateTunnelID()
+			}
+
+			capabilities := tunnel.NegotiateCapabilities(tunnel.Capabilities, msg.Capabilities)
+			tunnelConn := tunnel.NewTunnel(tunnelID, conn)
+			tunnelConn.SetCompression(s.opts.Compression)
+			tunnelConn.SetPeer(version, capabilities, msg.Client)
+
+			// 发送注册成功消息，附带服务端协议版本和双方都支持的能力
+			response := tunnel.Message{
+				Type:         tunnel.MessageTypeResponse,
+				TunnelID:     tunnelID,
+				Version:      tunnel.ProtocolVersion,
+				Capabilities: capabilities,
+			}
+			conn.WriteJSON(response)
+
+			// 注册成功消息发出后再注册隧道，等待中的请求不会先于它到达客户端
+			s.manager.AddTunnel(tunnelConn)
+
+			if msg.Client != nil {
+				log.Printf("隧道注册成功: %s（协议 v%d，客户端 %s）", tunnelID, version, msg.Client)
+			} else {
+				log.Printf("隧道注册成功: %s（协议 v%d）", tunnelID, version)
+			}
+			s.claimTunnel(tunnelID)
+			s.opts.Events.TunnelConnected(tunnelID, c.Request)
+
+			// 启动消息分发器，连接断开后移除隧道及其发布的私有服务
+			tunnelConn.SetMessageHandler(s.handleTunnelMessage(tunnelConn))
+			tunnelConn.StartMessageDispatcher()
+			<-tunnelConn.Done()
+			s.removeServices(tunnelConn)
+			s.manager.UnregisterTunnel(tunnelConn)
+			s.releaseTunnel(tunnelID)
+			s.opts.Events.TunnelDisconnected(tunnelID)
+			return
+		} else if msg.Type == tunnel.MessageTypePong {
+			// 心跳响应
+			if tunnelConn, exists := s.manager.GetTunnel(msg.TunnelID); exists {
+				tunnelConn.UpdatePing()
+			}
+		}
+	}
+}
+
+// handleProxyRequest 处理代理请求（外部HTTP请求）
+func (s *Server) handleProxyRequest(c *gin.Context) {
+	tunnelID := c.Param("tunnelID")
+	path := c.Param("path")
+	s.processProxyRequest(c, tunnelID, path)
+}
+
+// handleDefaultProxyRequest 处理无隧道前缀的代理请求
+// 作为 NoRoute 处理器，处理所有未匹配的路由
+func (s *Server) handleDefaultProxyRequest(c *gin.Context) {
+	// 从请求URL获取路径
+	path := c.Request.URL.Path
+
+	// 确保路径以 / 开头
+	if path == "" {
+		path = "/"
+	}
+
+	tunnelID, err := s.selectTunnel(c)
+	if err != nil {
+		if errors.Is(err, ErrAmbiguousTunnel) {
+			s.writeError(c, tunnel.ErrBadRequest, err.Error())
+		} else {
+			s.writeOffline(c, "", tunnel.ErrTunnelNotFound, err.Error())
+		}
+		return
+	}
+
+	s.processProxyRequest(c, tunnelID, path)
+}
+
+// processProxyRequest 统一的代理处理逻辑
+func (s *Server) processProxyRequest(c *gin.Context, tunnelID, path string) {
+	// 获取隧道连接
+	tunnelConn, exists := s.manager.GetTunnel(tunnelID)
+	if !exists {
+		// 集群模式下隧道可能连接在其他节点
+		if s.forwardToOwner(c, tunnelID, path) {
+			return
+		}
+		// 客户端重启期间，幂等请求等待其重连
+		if tunnelConn, exists = s.waitTunnel(c, tunnelID); !exists {
+			s.writeOffline(c, tunnelID, tunnel.ErrTunnelNotFound, "隧道不存在或未连接")
+			return
+		}
+	}
+
+	// 客户端上报本地服务健康检查失败时不再转发
+	if healthy, reason := tunnelConn.UpstreamHealthy(tunnel.UpstreamHTTP); !healthy {
+		s.writeOffline(c, tunnelID, tunnel.ErrUpstreamUnreachable, "本地服务健康检查失败: "+reason)
+		return
+	}
+
+	// 构建请求消息
+	requestID := generateRequestID()
+	// 将查询参数附加到路径上
+	fullPath := path
+	if c.Request.URL.RawQuery != "" {
+		fullPath = path + "?" + c.Request.URL.RawQuery
+	}
+	headers := c.Request.Header
+	rewrite := s.rewrite(tunnelID)
+	// SSE、流式响应和 WebSocket 握手只改写响应头
+	var rewriteHead func(*tunnel.Message)
+	if rewrite != nil {
+		headers = rewrite.Request(headers)
+		origin := publicOrigin(c, path)
+		rewriteHead = func(head *tunnel.Message) { rewrite.ResponseHead(head, origin) }
+	}
+	msg := &tunnel.Message{
+		Type:    tunnel.MessageTypeRequest,
+		ID:      requestID,
+		Method:  c.Request.Method,
+		Path:    fullPath,
+		Headers: headers,
+	}
+
+	info := RequestInfo{
+		TunnelID: tunnelID,
+		ID:       requestID,
+		Kind:     "http",
+		Method:   c.Request.Method,
+		Path:     fullPath,
+	}
+	start := time.Now()
+	defer func() {
+		info.Status = c.Writer.Status()
+		info.Duration = time.Since(start)
+		s.opts.Events.RequestServed(info)
+	}()
+
+	timeouts := s.proxy.Timeouts(tunnelID)
+
+	// gRPC 等双向流请求：请求体边读边转发（旧版本客户端不支持时按普通请求转发）
+	if proxy.IsStreamRequest(c.Request) && tunnelConn.HasCapability(tunnel.CapabilityStream) {
+		info.Kind = "stream"
+		msg.Type = tunnel.MessageTypeStream
+		proxy.ForwardStream(c, tunnelConn, msg, timeouts, s.opts.ErrorPages, rewriteHead)
+		return
+	}
+
+	// 读取请求体
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		s.writeError(c, tunnel.ErrBadRequest, "读取请求体失败")
+		return
+	}
+	msg.Body = body
+
+	// 检查是否是SSE请求
+	if proxy.IsSSERequest(c.Request.Header) {
+		info.Kind = "sse"
+		proxy.ForwardSSE(c, tunnelConn, msg, timeouts, s.opts.ErrorPages, rewriteHead)
+		return
+	}
+
+	// 检查是否是WebSocket请求
+	if proxy.IsWebSocketRequest(c.Request.Header) {
+		info.Kind = "websocket"
+		if rewrite != nil {
+			// 升级请求直接使用外部请求的头部，改写后的头部同样作用于握手
+			c.Request.Header = headers
+		}
+		proxy.HandleWebSocketProxy(c, tunnelConn, requestID, fullPath, timeouts, s.opts.WSMaxMessageSize, s.opts.ErrorPages, rewriteHead)
+		return
+	}
+
+	// 转发HTTP请求（开启缓存时优先使用缓存）
+	respMsg, err := s.forwardCached(c, tunnelID, msg)
+	if err != nil {
+		s.writeError(c, tunnel.ErrInternal, "转发请求失败: "+err.Error())
+		return
+	}
+
+	if respMsg.Type == tunnel.MessageTypeError {
+		s.writeError(c, tunnel.CodeOf(respMsg), respMsg.Error)
+		return
+	}
+
+	if rewrite != nil {
+		rewrite.Response(respMsg, publicOrigin(c, path))
+	}
+
+	// 设置响应头
+	for key, values := range respMsg.Headers {
+		for _, value := range values {
+			c.Header(key, value)
+		}
+	}
+
+	// 返回响应
+	c.Data(respMsg.Status, c.GetHeader("Content-Type"), respMsg.Body)
+	proxy.WriteTrailers(c.Writer, respMsg.Trailers)
+}
+
+// forward 经隧道转发普通HTTP请求，请求发出后隧道断开时幂等请求等待客户端重连后重放一次
+func (s *Server) forward(c *gin.Context, tunnelID string, msg *tunnel.Message) (*tunnel.Message, error) {
+	respMsg, err := s.proxy.ForwardRequest(c.Request.Context(), tunnelID, msg)
+	if err == nil && respMsg.Type == tunnel.MessageTypeError && respMsg.Code == tunnel.ErrTunnelDisconnected {
+		if _, ok := s.waitTunnel(c, tunnelID); ok {
+			log.Printf("隧道 %s 已重连，重放请求 %s %s", tunnelID, msg.Method, msg.Path)
+			respMsg, err = s.proxy.ForwardRequest(c.Request.Context(), tunnelID, msg)
+		}
+	}
+	return respMsg, err
+}
+
+// writeError 按错误码返回错误响应
+func (s *Server) writeError(c *gin.Context, code tunnel.ErrorCode, message string) {
+	s.opts.ErrorPages.Write(c, code, message)
+}
+
+// withDefaults 为未设置的超时填充默认值
+func withDefaults(t Timeouts) Timeouts {
+	if t.Forward == 0 {
+		t.Forward = time.Duration(common.DefaultForwardTimeout) * time.Second
+	}
+	if t.SSE == 0 {
+		t.SSE = time.Duration(common.DefaultSSETimeout) * time.Second
+	}
+	if t.Upgrade == 0 {
+		t.Upgrade = time.Duration(common.DefaultUpgradeTimeout) * time.Second
+	}
+	return t
+}
+
+// generateTunnelID 生成隧道ID
+func generateTunnelID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return "tunnel-" + hex.EncodeToString(bytes)
+}
+
+// generateRequestID 生成请求ID
+func generateRequestID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return "req-" + hex.EncodeToString(bytes)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"awesomeProject/internal/common"
+	"awesomeProject/internal/proxy"
+	"awesomeProject/internal/tunnel"
+)
+
+// proxyHandshakeTimeout 代理握手的超时
+const proxyHandshakeTimeout = 30 * time.Second
+
+// ServeProxy 在 ln 上提供 SOCKS5/HTTP CONNECT 代理，每个目标由出口隧道的客户端连接，直到 ln 关闭
+// 出口隧道为 Options.ProxyTunnel，未设置时由 TunnelSelector 选择；客户端需配置允许的目标
+func (s *Server) ServeProxy(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("接受代理连接失败: %v", err)
+			continue
+		}
+		go s.handleProxyConn(conn)
+	}
+}
+
+// handleProxyConn 处理单个代理连接
+func (s *Server) handleProxyConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	req, err := proxy.ReadProxyRequest(conn, s.opts.ProxyAuth)
+	if err != nil {
+		log.Printf("代理握手失败 %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	tunnelID := s.opts.ProxyTunnel
+	if tunnelID == "" {
+		tunnelID, err = s.opts.Selector.SelectTunnel(nil, s.manager.TunnelIDs())
+		if err != nil {
+			req.Reject(err.Error(), false)
+			conn.Close()
+			return
+		}
+	}
+	tunnelConn, exists := s.manager.GetTunnel(tunnelID)
+	if !exists {
+		req.Reject("隧道不存在或未连接", false)
+		conn.Close()
+		return
+	}
+	if !tunnelConn.HasCapability(tunnel.CapabilityProxy) {
+		// 旧版本客户端会忽略目标地址而连接 tcp_target
+		req.Reject("出口隧道的客户端不支持代理，请升级客户端", false)
+		conn.Close()
+		return
+	}
+
+	connID := generateRequestID()
+	start := time.Now()
+	defer func() {
+		s.opts.Events.RequestServed(RequestInfo{
+			TunnelID: tunnelID,
+			ID:       connID,
+			Kind:     "proxy",
+			Path:     req.Target,
+			Duration: time.Since(start),
+		})
+	}()
+
+	// 注册响应通道
+	responseChan := tunnelConn.RegisterResponseChan(connID)
+	defer tunnelConn.UnregisterResponseChan(connID)
+
+	// 发送带目标地址的TCP初始化消息，等待客户端确认
+	initMsg := &tunnel.Message{
+		Type:   tunnel.MessageTypeTCPInit,
+		ID:     connID,
+		Target: req.Target,
+	}
+	if err := tunnelConn.SendMessage(initMsg); err != nil {
+		req.Reject("发送TCP初始化失败: "+err.Error(), false)
+		conn.Close()
+		return
+	}
+
+	select {
+	case msg := <-responseChan:
+		if msg.Type != tunnel.MessageTypeResponse {
+			reason := msg.Error
+			if reason == "" {
+				reason = "目标连接已关闭"
+			}
+			log.Printf("代理连接 %s 失败: %s", req.Target, reason)
+			notAllowed := tunnel.CodeOf(msg) == tunnel.ErrForbidden || strings.Contains(reason, common.ErrTargetNotAllowed.Error())
+			req.Reject(reason, notAllowed)
+			conn.Close()
+			return
+		}
+	case <-time.After(s.proxy.Timeouts(tunnelID).Forward):
+		tunnelConn.CancelStream(connID)
+		req.Reject("等待目标连接超时", false)
+		conn.Close()
+		return
+	case <-tunnelConn.Done():
+		req.Reject("隧道已断开", false)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	publicConn, err := req.Accept()
+	if err != nil {
+		tunnelConn.CancelStream(connID)
+		conn.Close()
+		return
+	}
+	relayTCP(publicConn, tunnelConn, connID, responseChan)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"awesomeProject/internal/tunnel"
+)
+
+// ServeTCP 在 ln 上接受TCP连接并经隧道转发到客户端的 tcp_target，直到 ln 关闭
+func (s *Server) ServeTCP(ln net.Listener) error {
+	for {
+		publicConn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("接受TCP连接失败: %v", err)
+			continue
+		}
+		go s.handleTCPConnection(publicConn)
+	}
+}
+
+// handleTCPConnection 处理单个TCP连接
+func (s *Server) handleTCPConnection(publicConn net.Conn) {
+	tunnelID, err := s.opts.Selector.SelectTunnel(nil, s.healthyTunnels(s.manager.TunnelIDs(), tunnel.UpstreamTCP))
+	if err != nil {
+		log.Printf("无可用隧道，拒绝TCP连接来自 %s: %v", publicConn.RemoteAddr().String(), err)
+		publicConn.Close()
+		return
+	}
+
+	tunnelConn, exists := s.manager.GetTunnel(tunnelID)
+	if !exists {
+		log.Printf("隧道 %s 不存在，拒绝TCP连接", tunnelID)
+		publicConn.Close()
+		return
+	}
+
+	connID := generateRequestID()
+	start := time.Now()
+	defer func() {
+		s.opts.Events.RequestServed(RequestInfo{
+			TunnelID: tunnelID,
+			ID:       connID,
+			Kind:     "tcp",
+			Path:     publicConn.RemoteAddr().String(),
+			Duration: time.Since(start),
+		})
+	}()
+
+	// 注册响应通道
+	responseChan := tunnelConn.RegisterResponseChan(connID)
+	defer tunnelConn.UnregisterResponseChan(connID)
+
+	// 发送TCP初始化消息
+	initMsg := &tunnel.Message{
+		Type: tunnel.MessageTypeTCPInit,
+		ID:   connID,
+	}
+	if err := tunnelConn.SendMessage(initMsg); err != nil {
+		log.Printf("发送TCP初始化失败: %v", err)
+		publicConn.Close()
+		return
+	}
+
+	relayTCP(publicConn, tunnelConn, connID, responseChan)
+}
+
+// relayTCP 在外部连接与隧道中的TCP流之间双向转发，直到任一端关闭
+func relayTCP(publicConn net.Conn, tunnelConn *tunnel.Tunnel, connID string, responseChan chan *tunnel.Message) {
+	// 从公网读取数据并转发给内网，客户端写入本地连接慢时等待其接收窗口
+	window := tunnelConn.NewSendWindow(connID)
+	defer window.Close()
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := publicConn.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+				dataMsg := &tunnel.Message{
+					Type: tunnel.MessageTypeTCPData,
+					ID:   connID,
+					Body: data,
+				}
+				if err := window.Send(dataMsg); err != nil {
+					if !errors.Is(err, tunnel.ErrWindowClosed) {
+						log.Printf("发送TCP数据失败: %v", err)
+					}
+					break
+				}
+			}
+			if err != nil {
+				closeMsg := &tunnel.Message{
+					Type: tunnel.MessageTypeTCPClose,
+					ID:   connID,
+				}
+				tunnelConn.SendMessage(closeMsg)
+				break
+			}
+		}
+	}()
+
+	// 从内网读取数据并转发给公网；公网连接关闭后读取协程会通知客户端 tcp_close
+	defer publicConn.Close()
+	for {
+		var msg *tunnel.Message
+		select {
+		case msg = <-responseChan:
+		case <-tunnelConn.Done():
+			return
+		}
+
+		switch msg.Type {
+		case tunnel.MessageTypeTCPData:
+			if _, err := publicConn.Write(msg.Body); err != nil {
+				log.Printf("写入公网TCP失败: %v", err)
+				return
+			}
+		case tunnel.MessageTypeTCPClose, tunnel.MessageTypeCancel, tunnel.MessageTypeError:
+			return
+		}
+	}
+}
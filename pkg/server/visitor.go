@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/tunnel"
+)
+
+// privateService 客户端发布的私有TCP服务
+type privateService struct {
+	tunnel *tunnel.Tunnel
+	secret string
+}
+
+// serviceRegistry 服务名称 -> 发布该服务的隧道
+type serviceRegistry struct {
+	mu       sync.Mutex
+	services map[string]*privateService
+}
+
+// handleTunnelMessage 处理客户端主动发起的消息（发布私有服务、访问者连接）
+func (s *Server) handleTunnelMessage(t *tunnel.Tunnel) func(*tunnel.Message) bool {
+	return func(msg *tunnel.Message) bool {
+		switch msg.Type {
+		case tunnel.MessageTypeServiceRegister:
+			s.registerService(t, msg)
+			return true
+		case tunnel.MessageTypeTCPInit:
+			if msg.Service == "" {
+				return false
+			}
+			s.openVisitorStream(t, msg)
+			return true
+		}
+		return false
+	}
+}
+
+// registerService 登记私有服务，名称已被其他在线隧道占用时拒绝
+func (s *Server) registerService(t *tunnel.Tunnel, msg *tunnel.Message) {
+	reply := &tunnel.Message{
+		Type:    tunnel.MessageTypeResponse,
+		Service: msg.Service,
+	}
+
+	s.services.mu.Lock()
+	existing, exists := s.services.services[msg.Service]
+	switch {
+	case msg.Service == "" || msg.Secret == "":
+		reply.Type = tunnel.MessageTypeError
+		reply.Error = "私有服务名称和密钥不能为空"
+	case exists && existing.tunnel != t && !isClosed(existing.tunnel):
+		reply.Type = tunnel.MessageTypeError
+		reply.Error = "私有服务名称已被其他隧道占用"
+	default:
+		s.services.services[msg.Service] = &privateService{tunnel: t, secret: msg.Secret}
+	}
+	s.services.mu.Unlock()
+
+	if reply.Type == tunnel.MessageTypeError {
+		log.Printf("发布私有服务失败 %s (隧道 %s): %s", msg.Service, t.ID, reply.Error)
+	} else {
+		log.Printf("私有服务已发布: %s (隧道 %s)", msg.Service, t.ID)
+	}
+	t.SendMessage(reply)
+}
+
+// removeServices 移除隧道发布的所有私有服务
+func (s *Server) removeServices(t *tunnel.Tunnel) {
+	s.services.mu.Lock()
+	defer s.services.mu.Unlock()
+	for name, svc := range s.services.services {
+		if svc.tunnel == t {
+			delete(s.services.services, name)
+			log.Printf("私有服务已下线: %s", name)
+		}
+	}
+}
+
+// lookupService 校验密钥并返回发布服务的隧道
+func (s *Server) lookupService(name, secret string) (*tunnel.Tunnel, bool) {
+	s.services.mu.Lock()
+	defer s.services.mu.Unlock()
+	svc, exists := s.services.services[name]
+	if !exists || subtle.ConstantTimeCompare([]byte(svc.secret), []byte(secret)) != 1 {
+		return nil, false
+	}
+	return svc.tunnel, true
+}
+
+// openVisitorStream 为访问者的连接在发布方隧道上打开一条TCP流，并在两条隧道之间转发
+// 在分发协程中同步登记响应通道，访问者随后发送的数据不会丢失
+func (s *Server) openVisitorStream(visitor *tunnel.Tunnel, msg *tunnel.Message) {
+	provider, ok := s.lookupService(msg.Service, msg.Secret)
+	if !ok {
+		// 服务不存在与密钥错误返回相同的错误，不暴露服务是否存在
+		log.Printf("拒绝访问私有服务 %s (隧道 %s)", msg.Service, visitor.ID)
+		visitor.SendMessage(tunnel.NewError(msg.ID, tunnel.ErrAuthFailed, "私有服务不存在或密钥错误"))
+		return
+	}
+
+	// 发布方的客户端版本不支持时直接拒绝，避免旧版本忽略这些字段
+	var unsupported string
+	switch {
+	case msg.Target != "" && !provider.HasCapability(tunnel.CapabilityProxy):
+		unsupported = "发布方客户端不支持代理访问，请升级发布方客户端"
+	case msg.Handshake != nil && !provider.HasCapability(tunnel.CapabilityE2E):
+		unsupported = "发布方客户端不支持端到端加密，请升级发布方客户端"
+	}
+	if unsupported != "" {
+		visitor.SendMessage(tunnel.NewError(msg.ID, tunnel.ErrBadRequest, unsupported))
+		return
+	}
+
+	visitorID := msg.ID
+	providerID := generateRequestID()
+	visitorChan := visitor.RegisterResponseChan(visitorID)
+	providerChan := provider.RegisterResponseChan(providerID)
+
+	initMsg := &tunnel.Message{
+		Type:      tunnel.MessageTypeTCPInit,
+		ID:        providerID,
+		Service:   msg.Service,
+		Target:    msg.Target,
+		Handshake: msg.Handshake,
+	}
+	if err := provider.SendMessage(initMsg); err != nil {
+		visitor.UnregisterResponseChan(visitorID)
+		provider.UnregisterResponseChan(providerID)
+		visitor.SendMessage(tunnel.NewError(visitorID, tunnel.ErrTunnelDisconnected, "连接私有服务失败: "+err.Error()))
+		return
+	}
+
+	go s.relayVisitorStream(msg.Service, visitor, visitorID, visitorChan, provider, providerID, providerChan)
+}
+
+// relayVisitorStream 在访问者与发布方之间转发TCP消息，直到任一端关闭
+func (s *Server) relayVisitorStream(service string, visitor *tunnel.Tunnel, visitorID string, visitorChan chan *tunnel.Message, provider *tunnel.Tunnel, providerID string, providerChan chan *tunnel.Message) {
+	start := time.Now()
+	defer func() {
+		visitor.UnregisterResponseChan(visitorID)
+		provider.UnregisterResponseChan(providerID)
+		s.opts.Events.RequestServed(RequestInfo{
+			TunnelID: provider.ID,
+			ID:       providerID,
+			Kind:     "visitor",
+			Path:     service,
+			Duration: time.Since(start),
+		})
+	}()
+
+	closeMsg := func(id string) *tunnel.Message {
+		return &tunnel.Message{Type: tunnel.MessageTypeTCPClose, ID: id}
+	}
+
+	// 两个方向分别转发：一端消费慢时只等待该方向的发送窗口，另一个方向不受影响
+	toProvider := provider.NewSendWindow(providerID)
+	toVisitor := visitor.NewSendWindow(visitorID)
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			close(done)
+			toProvider.Close()
+			toVisitor.Close()
+		})
+	}
+	defer finish()
+
+	go func() {
+		defer finish()
+		for {
+			select {
+			case msg := <-visitorChan:
+				switch msg.Type {
+				case tunnel.MessageTypeTCPData:
+					if toProvider.Send(&tunnel.Message{Type: tunnel.MessageTypeTCPData, ID: providerID, Body: msg.Body}) != nil {
+						// 发布方一侧已结束（取消或隧道断开）
+						visitor.SendMessage(closeMsg(visitorID))
+						return
+					}
+				case tunnel.MessageTypeTCPClose, tunnel.MessageTypeCancel, tunnel.MessageTypeError:
+					provider.SendMessage(closeMsg(providerID))
+					return
+				}
+			case <-visitor.Done():
+				provider.SendMessage(closeMsg(providerID))
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-providerChan:
+			switch msg.Type {
+			case tunnel.MessageTypeTCPData:
+				if toVisitor.Send(&tunnel.Message{Type: tunnel.MessageTypeTCPData, ID: visitorID, Body: msg.Body}) != nil {
+					// 访问者一侧已结束（取消或隧道断开）
+					provider.SendMessage(closeMsg(providerID))
+					return
+				}
+			case tunnel.MessageTypeResponse:
+				// 发布方已连接目标（代理流）或回复端到端加密握手
+				visitor.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeResponse, ID: visitorID, Handshake: msg.Handshake, Body: msg.Body})
+			case tunnel.MessageTypeError:
+				visitor.SendMessage(&tunnel.Message{Type: tunnel.MessageTypeError, ID: visitorID, Code: msg.Code, Error: msg.Error})
+				return
+			case tunnel.MessageTypeTCPClose, tunnel.MessageTypeCancel:
+				visitor.SendMessage(closeMsg(visitorID))
+				return
+			}
+		case <-provider.Done():
+			visitor.SendMessage(closeMsg(visitorID))
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// isClosed 隧道是否已关闭
+func isClosed(t *tunnel.Tunnel) bool {
+	select {
+	case <-t.Done():
+		return true
+	default:
+		return false
+	}
+}